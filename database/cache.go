@@ -0,0 +1,266 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultCacheTTL is how long stored plugin results are reused if Cache.TTL is not set
+const DefaultCacheTTL = 24 * time.Hour
+
+// cacheMaxEntries is the number of in-process entries and hashes after which they are pruned
+const cacheMaxEntries = 1024
+
+// Cache wraps a backend that implements Querier so plugins can skip scanning samples
+// that were already scanned by the same plugin, engine and signature version:
+//
+//	cache, err := database.NewCache(db, 12*time.Hour)
+//	hit, ok, err := cache.Lookup(ctx, database.CacheKey{
+//		SHA256: sha256, Category: "av", Name: "clamav",
+//		Versions: map[string]interface{}{"engine": engine, "updated": updated},
+//	})
+//	if ok {
+//		// reuse hit.Data instead of scanning
+//	}
+//
+// Writes go to the wrapped backend, results stored through the Cache are also
+// remembered in-process so repeated lookups do not hit the backend.
+type Cache struct {
+	Database
+	Querier
+
+	// TTL is the maximum age of reused results (default 24h)
+	TTL time.Duration
+
+	mu      sync.Mutex
+	hashes  map[string]cachedHash // sample ID -> sha256
+	entries map[string]CacheHit
+}
+
+// cachedHash is the sha256 of a sample stored through the Cache
+type cachedHash struct {
+	sha256 string
+	stored time.Time
+}
+
+// CacheKey identifies the results of a plugin for a sample
+type CacheKey struct {
+	SHA256   string
+	Category string
+	Name     string
+	// Versions are plugin result fields that must be equal, e.g. the engine version and signature date
+	Versions map[string]interface{}
+}
+
+// CacheHit is a plugin's stored results that can be reused
+type CacheHit struct {
+	ID   string
+	Data map[string]interface{}
+	// ScanDate is when the plugin's results were written (see Sample.PluginDate)
+	ScanDate time.Time
+}
+
+// NewCache wraps db, which must implement Querier, in a Cache with the given TTL
+func NewCache(db Database, ttl time.Duration) (*Cache, error) {
+
+	q, ok := db.(Querier)
+	if !ok {
+		return nil, errors.Errorf("database %T does not support queries", db)
+	}
+
+	return &Cache{Database: db, Querier: q, TTL: ttl}, nil
+}
+
+func (c *Cache) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return DefaultCacheTTL
+	}
+	return c.TTL
+}
+
+// Lookup returns the results of the plugin for the sample if they were stored
+// within the TTL with the same versions
+func (c *Cache) Lookup(ctx context.Context, key CacheKey) (CacheHit, bool, error) {
+
+	if len(key.SHA256) == 0 || len(key.Category) == 0 || len(key.Name) == 0 {
+		return CacheHit{}, false, errors.New("CacheKey.SHA256, CacheKey.Category and CacheKey.Name are required")
+	}
+
+	since := time.Now().Add(-c.ttl())
+	id := cacheID(key)
+
+	c.mu.Lock()
+	hit, ok := c.entries[id]
+	c.mu.Unlock()
+
+	if ok && hit.ScanDate.After(since) && fieldsMatch(hit.Data, key.Versions) {
+		log.WithFields(log.Fields{
+			"sha256":   key.SHA256,
+			"category": key.Category,
+			"plugin":   key.Name,
+		}).Debug("plugin results found in cache")
+		// the caller may modify the data, the cached entry must not change
+		hit.Data = CopyValue(hit.Data).(map[string]interface{})
+		return hit, true, nil
+	}
+
+	// the sample's scan_date is bumped by every write so the age of the plugin's own results is checked
+	samples, err := c.ListScans(ctx, ScanFilter{
+		Hash:         key.SHA256,
+		Category:     key.Category,
+		Name:         key.Name,
+		Fields:       key.Versions,
+		ResultsSince: since,
+		Limit:        1,
+	})
+	if err != nil {
+		return CacheHit{}, false, errors.Wrapf(err, "failed to look up results of plugin %s for sample %s", key.Name, key.SHA256)
+	}
+	if len(samples) == 0 {
+		return CacheHit{}, false, nil
+	}
+
+	data, _ := samples[0].PluginResults(key.Category, key.Name)
+	scanDate, _ := samples[0].PluginDate(key.Category, key.Name)
+	hit = CacheHit{ID: samples[0].ID, Data: data, ScanDate: scanDate}
+	c.remember(id, CacheHit{ID: hit.ID, Data: CopyValue(data).(map[string]interface{}), ScanDate: scanDate})
+
+	log.WithFields(log.Fields{
+		"id":       hit.ID,
+		"sha256":   key.SHA256,
+		"category": key.Category,
+		"plugin":   key.Name,
+	}).Debug("plugin results found in database")
+
+	return hit, true, nil
+}
+
+// LookupHash returns all samples with the given md5, sha1, sha256 or sha512 (newest first)
+func (c *Cache) LookupHash(ctx context.Context, hash string) ([]Sample, error) {
+	return c.FindByHash(ctx, hash)
+}
+
+// StoreFileInfo stores the sample info and remembers the sample's sha256
+func (c *Cache) StoreFileInfo(ctx context.Context, sample map[string]interface{}) (Result, error) {
+
+	res, err := c.Database.StoreFileInfo(ctx, sample)
+	if err != nil {
+		return res, err
+	}
+
+	if sha256, ok := SampleID(sample); ok {
+		c.mu.Lock()
+		if c.hashes == nil {
+			c.hashes = make(map[string]cachedHash)
+		}
+		if len(c.hashes) >= cacheMaxEntries {
+			c.prune()
+		}
+		c.hashes[res.ID] = cachedHash{sha256: sha256, stored: time.Now()}
+		c.mu.Unlock()
+	}
+
+	return res, nil
+}
+
+// StorePluginResults stores the plugin's results and remembers them for lookups
+// if the sample's info was stored through the Cache. Results merged into or appended
+// to the previous ones are not remembered, lookups read the merged results from the backend.
+func (c *Cache) StorePluginResults(ctx context.Context, results PluginResults) (Result, error) {
+
+	res, err := c.Database.StorePluginResults(ctx, results)
+	if err != nil {
+		return res, err
+	}
+
+	c.mu.Lock()
+	hash, ok := c.hashes[results.ID]
+	c.mu.Unlock()
+
+	if !ok {
+		return res, nil
+	}
+
+	id := cacheID(CacheKey{SHA256: hash.sha256, Category: results.Category, Name: results.Name})
+	if results.Merge != "" && results.Merge != MergeReplace {
+		c.mu.Lock()
+		delete(c.entries, id)
+		c.mu.Unlock()
+		return res, nil
+	}
+
+	c.remember(id, CacheHit{
+		ID:       results.ID,
+		Data:     CopyValue(results.Data).(map[string]interface{}),
+		ScanDate: time.Now(),
+	})
+
+	return res, nil
+}
+
+// remember adds a hit to the in-process cache pruning expired entries once it grows
+func (c *Cache) remember(id string, hit CacheHit) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]CacheHit)
+	}
+
+	if len(c.entries) >= cacheMaxEntries {
+		c.prune()
+	}
+
+	c.entries[id] = hit
+}
+
+// prune removes the expired entries and the hashes of samples stored before the TTL
+// and then the oldest ones until a quarter of the space is free, results stored for
+// samples whose hash was removed are only found in the backend
+func (c *Cache) prune() {
+
+	since := time.Now().Add(-c.ttl())
+
+	for key, cached := range c.entries {
+		if !cached.ScanDate.After(since) {
+			delete(c.entries, key)
+		}
+	}
+	for id, hash := range c.hashes {
+		if !hash.stored.After(since) {
+			delete(c.hashes, id)
+		}
+	}
+
+	if len(c.entries) >= cacheMaxEntries {
+		keys := make([]string, 0, len(c.entries))
+		for key := range c.entries {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return c.entries[keys[i]].ScanDate.Before(c.entries[keys[j]].ScanDate) })
+		for _, key := range keys[:len(keys)-cacheMaxEntries*3/4] {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.hashes) >= cacheMaxEntries {
+		ids := make([]string, 0, len(c.hashes))
+		for id := range c.hashes {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return c.hashes[ids[i]].stored.Before(c.hashes[ids[j]].stored) })
+		for _, id := range ids[:len(ids)-cacheMaxEntries*3/4] {
+			delete(c.hashes, id)
+		}
+	}
+}
+
+func cacheID(key CacheKey) string {
+	return strings.ToLower(key.SHA256) + "/" + key.Category + "/" + key.Name
+}
@@ -0,0 +1,106 @@
+package database_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/database/databasetest"
+	"github.com/malice-plugins/go-plugin-utils/database/memory"
+)
+
+func TestCacheTTL(t *testing.T) {
+
+	ctx := context.Background()
+	db := &memory.Database{}
+	sample := databasetest.Sample(t.Name())
+	sha256 := sample["sha256"].(string)
+
+	res, err := db.StoreFileInfo(ctx, sample)
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	clamav := database.PluginResults{ID: res.ID, Category: "av", Name: "clamav", Data: map[string]interface{}{"engine": "0.100.1"}}
+	if _, err := db.StorePluginResults(ctx, clamav); err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+
+	cache, err := database.NewCache(db, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewCache() failed: %v", err)
+	}
+	key := database.CacheKey{SHA256: sha256, Category: "av", Name: "clamav", Versions: map[string]interface{}{"engine": "0.100.1"}}
+
+	if _, ok, err := cache.Lookup(ctx, key); err != nil || !ok {
+		t.Fatalf("Lookup() of fresh results returned %v, %v", ok, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// other writes bump the sample's scan_date but not the age of the clamav results
+	if _, err := cache.StoreFileInfo(ctx, sample); err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	if _, err := db.StorePluginResults(ctx, database.PluginResults{ID: res.ID, Category: "exe", Name: "pe", Data: map[string]interface{}{"machine": "x86"}}); err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+
+	cache, _ = database.NewCache(db, 50*time.Millisecond)
+	if hit, ok, err := cache.Lookup(ctx, key); err != nil || ok {
+		t.Fatalf("Lookup() of expired results returned %+v, %v, %v", hit, ok, err)
+	}
+
+	if _, err := cache.StorePluginResults(ctx, clamav); err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	if _, ok, err := cache.Lookup(ctx, key); err != nil || !ok {
+		t.Fatalf("Lookup() of rewritten results returned %v, %v", ok, err)
+	}
+}
+
+func TestCacheCopiesResults(t *testing.T) {
+
+	ctx := context.Background()
+	cache, err := database.NewCache(&memory.Database{}, time.Hour)
+	if err != nil {
+		t.Fatalf("NewCache() failed: %v", err)
+	}
+	sample := databasetest.Sample(t.Name())
+	res, err := cache.StoreFileInfo(ctx, sample)
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	key := database.CacheKey{SHA256: sample["sha256"].(string), Category: "av", Name: "clamav"}
+
+	data := map[string]interface{}{"result": "clean", "engine": map[string]interface{}{"version": "0.100.1"}}
+	if _, err := cache.StorePluginResults(ctx, database.PluginResults{ID: res.ID, Category: "av", Name: "clamav", Data: data}); err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	data["result"] = "EICAR"
+	data["engine"].(map[string]interface{})["version"] = "0.101.0"
+
+	hit, ok, err := cache.Lookup(ctx, key)
+	if err != nil || !ok {
+		t.Fatalf("Lookup() returned %v, %v", ok, err)
+	}
+	if hit.Data["result"] != "clean" || hit.Data["engine"].(map[string]interface{})["version"] != "0.100.1" {
+		t.Fatalf("Lookup() returned %v, the stored results were changed by the caller", hit.Data)
+	}
+	hit.Data["result"] = "EICAR"
+	if hit, _, _ := cache.Lookup(ctx, key); hit.Data["result"] != "clean" {
+		t.Fatalf("Lookup() returned %v, the cached results were changed by the caller", hit.Data)
+	}
+
+	// merged results are read back from the backend
+	if _, err := cache.StorePluginResults(ctx, database.PluginResults{ID: res.ID, Category: "av", Name: "clamav", Merge: database.MergeDeep, Data: map[string]interface{}{"infected": false}}); err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	hit, ok, err = cache.Lookup(ctx, key)
+	if err != nil || !ok {
+		t.Fatalf("Lookup() returned %v, %v", ok, err)
+	}
+	if hit.Data["result"] != "clean" || hit.Data["infected"] != false {
+		t.Fatalf("Lookup() returned %v, expected the merged results", hit.Data)
+	}
+}
@@ -3,19 +3,61 @@ Package database provides libraries to write plugin results to a database.
 */
 package database
 
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
 // PluginResults a malice plugin results object
 type PluginResults struct {
 	ID       string                 `json:"id"`
 	Name     string                 `json:"name,omitempty"`
 	Category string                 `json:"category,omitempty"`
 	Data     map[string]interface{} `json:"data,omitempty"`
+	// Merge controls how Data is written over the plugin's previous results (default MergeReplace)
+	Merge MergeStrategy `json:"merge,omitempty"`
+}
+
+// Result is the backend-neutral outcome of a database write
+type Result struct {
+	// ID is the ID of the document that was written
+	ID string `json:"id"`
+	// Version is the document version after the write (if the backend tracks versions)
+	Version int64 `json:"version,omitempty"`
+	// Index is the elasticsearch index or rethinkdb table that was written to
+	Index string `json:"index,omitempty"`
+	// Scan is the ID of the scan recorded by the write (if the backend keeps a scan history)
+	Scan string `json:"scan,omitempty"`
 }
 
-// Database is a Malice Database interface
+// Database is a Malice Database interface.
+// StorePluginResults upserts the sample's document, so the plugins placeholder a
+// backend writes with StoreFileInfo and StoreHash (its Plugins field) is optional.
 type Database interface {
-	Init() error
-	TestConnection() error
-	StoreFileInfo(sample map[string]interface{}) error
-	StoreHash(hash string) error
-	StorePluginResults(results PluginResults) error
+	Init(ctx context.Context) error
+	TestConnection(ctx context.Context) error
+	StoreFileInfo(ctx context.Context, sample map[string]interface{}) (Result, error)
+	StoreHash(ctx context.Context, hash string) (Result, error)
+	StorePluginResults(ctx context.Context, results PluginResults) (Result, error)
+	Close() error
+}
+
+// NewID returns a random document or scan ID
+func NewID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
+
+// SampleID returns the lowercase sha256 of a sample's file info, the ID of its
+// document in backends that key samples by hash
+func SampleID(sample map[string]interface{}) (string, bool) {
+	sha256, _ := sample["sha256"].(string)
+	sha256 = strings.ToLower(strings.TrimSpace(sha256))
+	return sha256, len(sha256) > 0
 }
@@ -0,0 +1,349 @@
+/*
+Package databasetest provides a conformance suite that every database.Database backend must pass.
+
+Backends call Run from their own tests with a factory returning a configured database:
+
+	func TestConformance(t *testing.T) {
+		databasetest.Run(t, func(t *testing.T) database.Database {
+			return &elasticsearch.Database{Plugins: map[string]interface{}{"av": nil}}
+		})
+	}
+
+Backends that do not implement database.Querier pass a ReadBack to RunWithReadBack
+so the merge strategy cases can check what was stored.
+*/
+package databasetest
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+// Timeout bounds every database call made by the suite
+var Timeout = 30 * time.Second
+
+// Factory returns a new backend for a single conformance test
+type Factory func(t *testing.T) database.Database
+
+// ReadBack reads the stored sample with the given ID back, the merge strategy cases
+// compare its plugins.<category>.<name> and history.<category>.<name>
+type ReadBack func(ctx context.Context, db database.Database, id string) (*database.Sample, error)
+
+// Run runs the database.Database conformance suite against the backends returned by newDB,
+// the merge strategy cases read samples back with GetSample if the backend implements database.Querier
+func Run(t *testing.T, newDB Factory) {
+	RunWithReadBack(t, newDB, nil)
+}
+
+// RunWithReadBack runs the conformance suite reading samples back with readBack,
+// backends that do not implement database.Querier pass one to run the merge strategy cases
+func RunWithReadBack(t *testing.T, newDB Factory, readBack ReadBack) {
+	merge := func(test func(ctx context.Context, t *testing.T, db database.Database, read ReadBack)) func(ctx context.Context, t *testing.T, db database.Database) {
+		return func(ctx context.Context, t *testing.T, db database.Database) {
+			read := readBack
+			if q, ok := db.(database.Querier); ok && read == nil {
+				read = func(ctx context.Context, _ database.Database, id string) (*database.Sample, error) {
+					return q.GetSample(ctx, id)
+				}
+			}
+			if read == nil {
+				t.Skip("the backend can not read samples back")
+			}
+			test(ctx, t, db, read)
+		}
+	}
+
+	tests := []struct {
+		name string
+		test func(ctx context.Context, t *testing.T, db database.Database)
+	}{
+		{"Init", testInit},
+		{"TestConnection", testConnection},
+		{"StoreFileInfo", testStoreFileInfo},
+		{"StoreHash", testStoreHash},
+		{"StoreHashInvalid", testStoreHashInvalid},
+		{"StorePluginResults", testStorePluginResults},
+		{"StorePluginResultsUpsert", testStorePluginResultsUpsert},
+		{"StorePluginResultsConcurrent", testStorePluginResultsConcurrent},
+		{"StorePluginResultsNoID", testStorePluginResultsNoID},
+		{"MergeReplace", merge(testMergeReplace)},
+		{"MergeDeep", merge(testMergeDeep)},
+		{"MergeAppend", merge(testMergeAppend)},
+		{"CanceledContext", testCanceledContext},
+		{"Close", testClose},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+			defer cancel()
+
+			db := newDB(t)
+			defer db.Close()
+			if err := db.Init(ctx); err != nil {
+				t.Fatalf("Init() failed: %v", err)
+			}
+			tt.test(ctx, t, db)
+		})
+	}
+}
+
+// Sample returns a file info object like the one malice passes to StoreFileInfo
+func Sample(content string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   "conformance.txt",
+		"path":   "/malware/conformance.txt",
+		"size":   fmt.Sprintf("%d B", len(content)),
+		"mime":   "text/plain",
+		"md5":    fmt.Sprintf("%x", md5.Sum([]byte(content))),
+		"sha1":   fmt.Sprintf("%x", sha1.Sum([]byte(content))),
+		"sha256": fmt.Sprintf("%x", sha256.Sum256([]byte(content))),
+		"sha512": fmt.Sprintf("%x", sha512.Sum512([]byte(content))),
+	}
+}
+
+func testInit(ctx context.Context, t *testing.T, db database.Database) {
+	// Init must be safe to call more than once
+	if err := db.Init(ctx); err != nil {
+		t.Fatalf("second Init() failed: %v", err)
+	}
+}
+
+func testConnection(ctx context.Context, t *testing.T, db database.Database) {
+	if err := db.TestConnection(ctx); err != nil {
+		t.Fatalf("TestConnection() failed: %v", err)
+	}
+}
+
+func testStoreFileInfo(ctx context.Context, t *testing.T, db database.Database) {
+	res, err := db.StoreFileInfo(ctx, Sample(t.Name()))
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	checkResult(t, "StoreFileInfo", res)
+}
+
+func testStoreHash(ctx context.Context, t *testing.T, db database.Database) {
+	res, err := db.StoreHash(ctx, Sample(t.Name())["sha256"].(string))
+	if err != nil {
+		t.Fatalf("StoreHash() failed: %v", err)
+	}
+	checkResult(t, "StoreHash", res)
+}
+
+func testStoreHashInvalid(ctx context.Context, t *testing.T, db database.Database) {
+	if _, err := db.StoreHash(ctx, "not-a-hash"); err == nil {
+		t.Fatal("StoreHash() with an invalid hash should return an error")
+	}
+}
+
+func testStorePluginResults(ctx context.Context, t *testing.T, db database.Database) {
+	sample, err := db.StoreFileInfo(ctx, Sample(t.Name()))
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+
+	res, err := db.StorePluginResults(ctx, database.PluginResults{
+		ID:       sample.ID,
+		Name:     "conformance",
+		Category: "av",
+		Data: map[string]interface{}{
+			"infected": true,
+			"result":   "EICAR-Test-File",
+		},
+	})
+	if err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	checkResult(t, "StorePluginResults", res)
+
+	if res.ID != sample.ID {
+		t.Errorf("StorePluginResults() wrote to document %q, expected %q", res.ID, sample.ID)
+	}
+}
+
+func testStorePluginResultsUpsert(ctx context.Context, t *testing.T, db database.Database) {
+	id := Sample(t.Name())["sha256"].(string)
+
+	res, err := db.StorePluginResults(ctx, database.PluginResults{
+		ID:       id,
+		Name:     "conformance",
+		Category: "exe",
+		Data:     map[string]interface{}{"machine": "x86"},
+	})
+	if err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	if res.ID != id {
+		t.Errorf("StorePluginResults() for a new sample created document %q, expected %q", res.ID, id)
+	}
+}
+
+func testStorePluginResultsConcurrent(ctx context.Context, t *testing.T, db database.Database) {
+	id := Sample(t.Name())["sha256"].(string)
+	categories := []string{"av", "exe", "intel", "metadata", "document", "archive"}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(categories))
+
+	for _, category := range categories {
+		wg.Add(1)
+		go func(category string) {
+			defer wg.Done()
+			res, err := db.StorePluginResults(ctx, database.PluginResults{
+				ID:       id,
+				Name:     "conformance",
+				Category: category,
+				Data:     map[string]interface{}{"category": category},
+			})
+			if err == nil && res.ID != id {
+				err = fmt.Errorf("%s results were written to document %q, expected %q", category, res.ID, id)
+			}
+			errs <- err
+		}(category)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent StorePluginResults() failed: %v", err)
+		}
+	}
+}
+
+func testStorePluginResultsNoID(ctx context.Context, t *testing.T, db database.Database) {
+	_, err := db.StorePluginResults(ctx, database.PluginResults{
+		Name:     "conformance",
+		Category: "av",
+	})
+	if err == nil {
+		t.Fatal("StorePluginResults() without an ID should return an error")
+	}
+}
+
+// storeResults writes the results of the conformance plugin with the given merge
+// strategy in order and returns the sample read back
+func storeResults(ctx context.Context, t *testing.T, db database.Database, read ReadBack, merge database.MergeStrategy, data ...map[string]interface{}) *database.Sample {
+	t.Helper()
+
+	sample, err := db.StoreFileInfo(ctx, Sample(t.Name()))
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	for _, d := range data {
+		if _, err := db.StorePluginResults(ctx, database.PluginResults{
+			ID:       sample.ID,
+			Name:     "conformance",
+			Category: "av",
+			Merge:    merge,
+			Data:     d,
+		}); err != nil {
+			t.Fatalf("StorePluginResults() failed: %v", err)
+		}
+	}
+
+	stored, err := read(ctx, db, sample.ID)
+	if err != nil {
+		t.Fatalf("reading back sample %s failed: %v", sample.ID, err)
+	}
+
+	return stored
+}
+
+func checkPluginResults(t *testing.T, sample *database.Sample, expected map[string]interface{}) {
+	t.Helper()
+	data, ok := sample.PluginResults("av", "conformance")
+	if !ok || !reflect.DeepEqual(data, expected) {
+		t.Fatalf("plugins.av.conformance is %v, expected %v", data, expected)
+	}
+}
+
+func testMergeReplace(ctx context.Context, t *testing.T, db database.Database, read ReadBack) {
+	sample := storeResults(ctx, t, db, read, database.MergeReplace,
+		map[string]interface{}{"result": "clean", "engine": map[string]interface{}{"version": "0.100.1"}},
+		map[string]interface{}{"engine": map[string]interface{}{"updated": "20180917"}},
+	)
+
+	checkPluginResults(t, sample, map[string]interface{}{"engine": map[string]interface{}{"updated": "20180917"}})
+	if history := sample.PluginHistory("av", "conformance"); len(history) != 0 {
+		t.Fatalf("replaced results have a history: %v", history)
+	}
+}
+
+func testMergeDeep(ctx context.Context, t *testing.T, db database.Database, read ReadBack) {
+	sample := storeResults(ctx, t, db, read, database.MergeDeep,
+		map[string]interface{}{"result": "clean", "engine": map[string]interface{}{"version": "0.100.1"}},
+		map[string]interface{}{"engine": map[string]interface{}{"updated": "20180917"}},
+	)
+
+	checkPluginResults(t, sample, map[string]interface{}{
+		"result": "clean",
+		"engine": map[string]interface{}{"version": "0.100.1", "updated": "20180917"},
+	})
+	if history := sample.PluginHistory("av", "conformance"); len(history) != 0 {
+		t.Fatalf("merged results have a history: %v", history)
+	}
+}
+
+func testMergeAppend(ctx context.Context, t *testing.T, db database.Database, read ReadBack) {
+	sample := storeResults(ctx, t, db, read, database.MergeAppend,
+		map[string]interface{}{"result": "clean"},
+		map[string]interface{}{"result": "EICAR-Test-File"},
+	)
+
+	checkPluginResults(t, sample, map[string]interface{}{"result": "EICAR-Test-File"})
+
+	history := sample.PluginHistory("av", "conformance")
+	if len(history) != 2 {
+		t.Fatalf("history.av.conformance has %d entries, expected 2", len(history))
+	}
+	for i, result := range []string{"clean", "EICAR-Test-File"} {
+		if history[i].Data["result"] != result {
+			t.Errorf("history entry %d is %v, expected the result %s", i, history[i].Data, result)
+		}
+		if history[i].ScanDate.IsZero() {
+			t.Errorf("history entry %d has no scan_date", i)
+		}
+	}
+}
+
+func testCanceledContext(ctx context.Context, t *testing.T, db database.Database) {
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := db.StoreFileInfo(canceled, Sample(t.Name())); err == nil {
+		t.Fatal("StoreFileInfo() with a canceled context should return an error")
+	}
+}
+
+func testClose(ctx context.Context, t *testing.T, db database.Database) {
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	// Close must be safe to call more than once
+	if err := db.Close(); err != nil {
+		t.Fatalf("second Close() failed: %v", err)
+	}
+}
+
+func checkResult(t *testing.T, op string, res database.Result) {
+	t.Helper()
+	if len(res.ID) == 0 {
+		t.Errorf("%s() returned an empty document ID", op)
+	}
+	if len(res.Index) == 0 {
+		t.Errorf("%s() returned an empty index/table", op)
+	}
+}
@@ -0,0 +1,116 @@
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// getTLS reads the TLS settings with the following order of precedence
+// - user input (cli)
+// - user ENV
+// - sane defaults
+func (db *Database) getTLS() {
+	db.CACert = utils.Getopts(db.CACert, "MALICE_ELASTICSEARCH_CA_CERT", "")
+	db.ClientCert = utils.Getopts(db.ClientCert, "MALICE_ELASTICSEARCH_CLIENT_CERT", "")
+	db.ClientKey = utils.Getopts(db.ClientKey, "MALICE_ELASTICSEARCH_CLIENT_KEY", "")
+	db.APIKey = utils.Getopts(db.APIKey, "MALICE_ELASTICSEARCH_API_KEY", "")
+	db.BearerToken = utils.Getopts(db.BearerToken, "MALICE_ELASTICSEARCH_BEARER_TOKEN", "")
+
+	if !db.InsecureSkipVerify {
+		db.InsecureSkipVerify, _ = strconv.ParseBool(utils.Getopt("MALICE_ELASTICSEARCH_INSECURE_SKIP_VERIFY", "false"))
+	}
+}
+
+// tlsConfig returns the TLS config of the connection or nil if the defaults are used
+func (db *Database) tlsConfig() (*tls.Config, error) {
+
+	if len(db.CACert) == 0 && len(db.ClientCert) == 0 && !db.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		InsecureSkipVerify: db.InsecureSkipVerify,
+	}
+
+	if db.InsecureSkipVerify {
+		log.Warn("elasticsearch TLS certificate verification is disabled")
+	}
+
+	if len(db.CACert) > 0 {
+		pem, err := ioutil.ReadFile(db.CACert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read CA bundle: %s", db.CACert)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in CA bundle: %s", db.CACert)
+		}
+		config.RootCAs = pool
+	}
+
+	if len(db.ClientCert) > 0 || len(db.ClientKey) > 0 {
+		if len(db.ClientCert) == 0 || len(db.ClientKey) == 0 {
+			return nil, errors.New("a client certificate requires both ClientCert and ClientKey")
+		}
+		cert, err := tls.LoadX509KeyPair(db.ClientCert, db.ClientKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load client certificate: %s", db.ClientCert)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// authHeader returns the Authorization header of the API key or bearer token (empty if neither is set)
+func (db *Database) authHeader() (string, error) {
+
+	if len(db.APIKey) > 0 && len(db.BearerToken) > 0 {
+		return "", errors.New("APIKey and BearerToken are mutually exclusive")
+	}
+
+	if len(db.APIKey) > 0 {
+		key := db.APIKey
+		// accept the "id:api_key" pair as well as its base64 encoding returned by the create API key API
+		if strings.Contains(key, ":") {
+			key = base64.StdEncoding.EncodeToString([]byte(key))
+		}
+		return "ApiKey " + key, nil
+	}
+
+	if len(db.BearerToken) > 0 {
+		return "Bearer " + db.BearerToken, nil
+	}
+
+	return "", nil
+}
+
+// headerTransport sets headers on every request sent through it
+type headerTransport struct {
+	header http.Header
+	base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+len(t.header))
+	for key, values := range req.Header {
+		clone.Header[key] = values
+	}
+	for key, values := range t.header {
+		clone.Header[key] = values
+	}
+	return t.base.RoundTrip(clone)
+}
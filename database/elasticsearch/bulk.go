@@ -0,0 +1,393 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBulkActions       = 1000
+	defaultBulkSize          = 5 << 20 // 5 MB
+	defaultBulkFlushInterval = 5 * time.Second
+)
+
+// BulkOptions configures a BulkWriter
+type BulkOptions struct {
+	// Actions is the number of buffered results that triggers a flush (default 1000)
+	Actions int
+	// Size is the number of buffered bytes that triggers a flush (default 5MB)
+	Size int
+	// FlushInterval flushes the buffer periodically (default 5s, a negative value disables it)
+	FlushInterval time.Duration
+	// MaxRetries is how often a retriable failure is retried before it is reported
+	// (default MaxAttempts-1 of the database's RetryPolicy, a negative value disables retries)
+	MaxRetries int
+	// Backoff controls the wait between retries (default the database's RetryPolicy)
+	Backoff elastic.Backoff
+	// OnFailure is called for every result that could not be written
+	OnFailure func(BulkFailure)
+}
+
+// BulkFailure is a plugin result that could not be written by a BulkWriter
+type BulkFailure struct {
+	Results database.PluginResults
+	Status  int
+	Err     error
+}
+
+// BulkError is returned by Flush and Close when some results could not be written
+type BulkError struct {
+	Failures []BulkFailure
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("failed to write %d plugin results (first error: %v)", len(e.Failures), e.Failures[0].Err)
+}
+
+// BulkStats are the counters of a BulkWriter
+type BulkStats struct {
+	Added     int64 // # of results added
+	Flushed   int64 // # of flushes
+	Committed int64 // # of _bulk requests sent (including retries)
+	Succeeded int64 // # of results written
+	Retried   int64 // # of results retried
+	Failed    int64 // # of results that could not be written
+}
+
+// BulkWriter buffers plugin results and writes them with the elasticsearch _bulk API.
+// The results of a sample are applied in the order they were added: a retried result
+// is followed by the sample's later results again, except appends which are not repeated.
+type BulkWriter struct {
+	db     *Database
+	client *elastic.Client
+	opts   BulkOptions
+
+	mu      sync.Mutex // guards the buffer and stats
+	pending []*bulkItem
+	size    int
+	stats   BulkStats
+
+	flushMu sync.Mutex // serializes flushes so results are written in order
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+type bulkItem struct {
+	results database.PluginResults
+	request *elastic.BulkUpdateRequest
+}
+
+// NewBulkWriter creates a BulkWriter storing plugin results in the database's index.
+// ctx bounds the periodic flushes, call Close to flush the remaining results.
+func (db *Database) NewBulkWriter(ctx context.Context, opts BulkOptions) (*BulkWriter, error) {
+
+	client, err := db.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Actions <= 0 {
+		opts.Actions = defaultBulkActions
+	}
+	if opts.Size <= 0 {
+		opts.Size = defaultBulkSize
+	}
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = defaultBulkFlushInterval
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = db.Retry.maxAttempts() - 1
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.Backoff == nil {
+		opts.Backoff = db.Retry
+	}
+
+	w := &BulkWriter{
+		db:     db,
+		client: client,
+		opts:   opts,
+		stopC:  make(chan struct{}),
+	}
+
+	if opts.FlushInterval > 0 {
+		w.wg.Add(1)
+		go w.flusher(ctx)
+	}
+
+	return w, nil
+}
+
+// Add buffers a plugin's results, flushing the buffer if it is full
+func (w *BulkWriter) Add(ctx context.Context, results database.PluginResults) error {
+
+	if len(results.ID) == 0 {
+		return errors.New("plugin results must have an ID to be written in bulk")
+	}
+	if err := results.Validate(); err != nil {
+		return err
+	}
+
+	script, upsert := resultsScript(results)
+
+	req := elastic.NewBulkUpdateRequest().
+		Index(w.db.Index).
+		Id(results.ID).
+		Script(script).
+		Upsert(upsert).
+		RetryOnConflict(retryOnConflict)
+	// elasticsearch 7+ has no mapping types
+	if !w.db.typeless() {
+		req = req.Type(w.db.Type)
+	}
+
+	lines, err := req.Source()
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode plugin results for sample with id: %s", results.ID)
+	}
+
+	w.mu.Lock()
+	w.pending = append(w.pending, &bulkItem{results: results, request: req})
+	w.size += len(strings.Join(lines, "\n")) + 1
+	w.stats.Added++
+	full := len(w.pending) >= w.opts.Actions || w.size >= w.opts.Size
+	w.mu.Unlock()
+
+	if full {
+		return w.Flush(ctx)
+	}
+
+	return nil
+}
+
+// Flush writes all buffered results
+func (w *BulkWriter) Flush(ctx context.Context) error {
+
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	items := w.pending
+	w.pending = nil
+	w.size = 0
+	if len(items) > 0 {
+		w.stats.Flushed++
+	}
+	w.mu.Unlock()
+
+	var failures []BulkFailure
+
+	if len(items) > 0 && w.db.Lifecycle.Enabled {
+		// samples are updated in the index they were written to and not the write alias
+		ids := make([]string, 0, len(items))
+		for _, item := range items {
+			ids = append(ids, item.results.ID)
+		}
+		indices, err := w.db.locate(ctx, w.client, ids...)
+		if err != nil {
+			return &BulkError{Failures: w.fail(items, 0, err)}
+		}
+		for _, item := range items {
+			item.request.Index(indices[item.results.ID])
+		}
+	}
+
+	// results for hash-only documents that were merged into a sample
+	var redirect []*bulkItem
+
+	var lastErr error
+	for attempt := 0; len(items) > 0; attempt++ {
+
+		if attempt > 0 {
+			wait, ok := w.opts.Backoff.Next(attempt)
+			if !ok {
+				// the backoff gave up before MaxRetries
+				failures = append(failures, w.fail(items, 0, errors.Wrapf(lastErr, "giving up after %d attempts", attempt))...)
+				break
+			}
+			select {
+			case <-ctx.Done():
+				failures = append(failures, w.fail(items, 0, ctx.Err())...)
+				items = nil
+				continue
+			case <-time.After(wait):
+			}
+		}
+
+		bulk := w.client.Bulk()
+		for _, item := range items {
+			bulk.Add(item.request)
+		}
+
+		w.mu.Lock()
+		w.stats.Committed++
+		w.mu.Unlock()
+
+		resp, err := bulk.Do(ctx)
+		if err != nil {
+			if w.db.Retry.retriable(err) && attempt < w.opts.MaxRetries {
+				if !w.db.Retry.unapplied(err) {
+					// the request may have been applied, retried appends could append their history entries twice
+					var retry, appends []*bulkItem
+					for _, item := range items {
+						if item.results.Merge == database.MergeAppend {
+							appends = append(appends, item)
+						} else {
+							retry = append(retry, item)
+						}
+					}
+					failures = append(failures, w.fail(appends, 0, errors.Wrap(err, "bulk request failed"))...)
+					items = retry
+				}
+				lastErr = err
+				log.WithFields(log.Fields{
+					"attempt": attempt + 1,
+					"items":   len(items),
+				}).WithError(err).Debug("bulk request failed, retrying")
+				w.addRetried(len(items))
+				continue
+			}
+			failures = append(failures, w.fail(items, 0, errors.Wrap(err, "bulk request failed"))...)
+			break
+		}
+
+		var retry []*bulkItem
+		// samples with retried results, their later results are retried after them to keep their order
+		retrying := make(map[string]bool)
+		// resp.Items are 1 to 1 with the requests in the same order
+		for i, entry := range resp.Items {
+			for _, res := range entry {
+				if res.Error == nil && retrying[items[i].results.ID] && items[i].results.Merge != database.MergeAppend {
+					// written before an earlier result that is retried, appends are not written twice
+					retry = append(retry, items[i])
+					continue
+				}
+				if res.Error == nil && res.Result == "noop" {
+					redirect = append(redirect, items[i])
+					continue
+				}
+				if res.Error == nil {
+					w.mu.Lock()
+					w.stats.Succeeded++
+					w.mu.Unlock()
+					continue
+				}
+				itemErr := errors.Errorf("%s: %s", res.Error.Type, res.Error.Reason)
+				if w.db.Retry.retriableStatus(res.Status) && attempt < w.opts.MaxRetries {
+					lastErr = itemErr
+					retrying[items[i].results.ID] = true
+					retry = append(retry, items[i])
+					continue
+				}
+				failures = append(failures, w.fail(items[i:i+1], res.Status, itemErr)...)
+			}
+		}
+
+		if len(retry) > 0 {
+			log.WithFields(log.Fields{
+				"attempt": attempt + 1,
+				"items":   len(retry),
+			}).Debug("bulk items failed, retrying")
+			w.addRetried(len(retry))
+		}
+
+		items = retry
+	}
+
+	for _, item := range redirect {
+		// StorePluginResults resolves the sample the document was merged into
+		if _, err := w.db.StorePluginResults(ctx, item.results); err != nil {
+			failures = append(failures, w.fail([]*bulkItem{item}, 0, err)...)
+			continue
+		}
+		w.mu.Lock()
+		w.stats.Succeeded++
+		w.mu.Unlock()
+	}
+
+	if len(failures) > 0 {
+		return &BulkError{Failures: failures}
+	}
+
+	return nil
+}
+
+// Close stops the periodic flushes and writes all buffered results
+func (w *BulkWriter) Close(ctx context.Context) error {
+
+	select {
+	case <-w.stopC:
+	default:
+		close(w.stopC)
+	}
+	w.wg.Wait()
+
+	return w.Flush(ctx)
+}
+
+// Stats returns the current counters of the BulkWriter
+func (w *BulkWriter) Stats() BulkStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
+
+func (w *BulkWriter) flusher(ctx context.Context) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopC:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Flush(ctx); err != nil {
+				log.WithError(err).Error("periodic bulk flush failed")
+			}
+		}
+	}
+}
+
+func (w *BulkWriter) fail(items []*bulkItem, status int, err error) []BulkFailure {
+
+	failures := make([]BulkFailure, 0, len(items))
+	for _, item := range items {
+		failure := BulkFailure{Results: item.results, Status: status, Err: err}
+		if w.opts.OnFailure != nil {
+			w.opts.OnFailure(failure)
+		}
+		log.WithFields(log.Fields{
+			"id":       item.results.ID,
+			"category": item.results.Category,
+			"plugin":   item.results.Name,
+			"status":   status,
+		}).WithError(err).Error("failed to write plugin results")
+		failures = append(failures, failure)
+	}
+
+	w.mu.Lock()
+	w.stats.Failed += int64(len(items))
+	w.mu.Unlock()
+
+	return failures
+}
+
+func (w *BulkWriter) addRetried(n int) {
+	w.mu.Lock()
+	w.stats.Retried += int64(n)
+	w.mu.Unlock()
+}
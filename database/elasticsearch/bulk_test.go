@@ -0,0 +1,174 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+// bulkIDs returns the document IDs of a _bulk request body in order
+func bulkIDs(body []byte) []string {
+	var ids []string
+	for _, line := range strings.Split(string(body), "\n") {
+		var action map[string]struct {
+			ID string `json:"_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &action); err != nil {
+			continue
+		}
+		if update, ok := action["update"]; ok {
+			ids = append(ids, update.ID)
+		}
+	}
+	return ids
+}
+
+// testBulkCluster returns a Database whose _bulk endpoint answers the nth request with
+// statuses[n] for the items in order (200 if missing) and records the IDs of every request
+func testBulkCluster(t *testing.T, statuses ...[]int) (*Database, func() [][]string, func()) {
+
+	var mu sync.Mutex
+	var requests [][]string
+
+	db, stop := testCluster(func(w http.ResponseWriter, r *http.Request, body []byte) {
+		if r.Method != "POST" || r.URL.Path != "/_bulk" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+			return
+		}
+
+		ids := bulkIDs(body)
+		mu.Lock()
+		n := len(requests)
+		requests = append(requests, ids)
+		mu.Unlock()
+
+		items := make([]string, len(ids))
+		for i, id := range ids {
+			status := 200
+			if n < len(statuses) && i < len(statuses[n]) {
+				status = statuses[n][i]
+			}
+			if status == 200 {
+				items[i] = fmt.Sprintf(`{"update":{"_index":"malice","_type":"samples","_id":%q,"status":200,"result":"updated"}}`, id)
+				continue
+			}
+			items[i] = fmt.Sprintf(`{"update":{"_index":"malice","_type":"samples","_id":%q,"status":%d,"error":{"type":"es_rejected_execution_exception","reason":"rejected"}}}`, id, status)
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":true,"items":[%s]}`, strings.Join(items, ","))
+	})
+
+	return db, func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}, stop
+}
+
+func bulkResults(id, name string, merge database.MergeStrategy) database.PluginResults {
+	return database.PluginResults{ID: id, Category: "av", Name: name, Merge: merge, Data: map[string]interface{}{"result": "clean"}}
+}
+
+func TestBulkWriterKeepsOrderPerSample(t *testing.T) {
+
+	ctx := context.Background()
+	// the first result of sample a is rejected, its later results are written again after it
+	db, requests, stop := testBulkCluster(t, []int{429, 200, 200, 200})
+	defer stop()
+
+	w, err := db.NewBulkWriter(ctx, BulkOptions{FlushInterval: -1})
+	if err != nil {
+		t.Fatalf("NewBulkWriter() failed: %v", err)
+	}
+	for _, results := range []database.PluginResults{
+		bulkResults("a", "clamav", database.MergeReplace),
+		bulkResults("b", "clamav", database.MergeReplace),
+		bulkResults("a", "avast", database.MergeDeep),
+		bulkResults("a", "avg", database.MergeAppend),
+	} {
+		if err := w.Add(ctx, results); err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+	}
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	// the appended results are not appended twice
+	expected := [][]string{{"a", "b", "a", "a"}, {"a", "a"}}
+	if !reflect.DeepEqual(requests(), expected) {
+		t.Fatalf("BulkWriter sent %v, expected %v", requests(), expected)
+	}
+	if stats := w.Stats(); stats.Succeeded != 4 || stats.Retried != 2 || stats.Failed != 0 {
+		t.Fatalf("Stats() returned %+v", stats)
+	}
+}
+
+func TestBulkWriterNoRetries(t *testing.T) {
+
+	ctx := context.Background()
+	db, requests, stop := testBulkCluster(t, []int{429, 200})
+	defer stop()
+
+	var failed []database.PluginResults
+	w, err := db.NewBulkWriter(ctx, BulkOptions{
+		FlushInterval: -1,
+		MaxRetries:    -1,
+		OnFailure:     func(f BulkFailure) { failed = append(failed, f.Results) },
+	})
+	if err != nil {
+		t.Fatalf("NewBulkWriter() failed: %v", err)
+	}
+	for _, results := range []database.PluginResults{bulkResults("a", "clamav", ""), bulkResults("b", "clamav", "")} {
+		if err := w.Add(ctx, results); err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+	}
+
+	err = w.Flush(ctx)
+	bulkErr, ok := err.(*BulkError)
+	if !ok || len(bulkErr.Failures) != 1 || bulkErr.Failures[0].Status != 429 {
+		t.Fatalf("Flush() returned %v, expected the rejected results", err)
+	}
+	if len(failed) != 1 || failed[0].ID != "a" {
+		t.Fatalf("OnFailure was called with %v", failed)
+	}
+	if len(requests()) != 1 {
+		t.Fatalf("BulkWriter sent %d requests, expected 1", len(requests()))
+	}
+	if stats := w.Stats(); stats.Succeeded != 1 || stats.Failed != 1 || stats.Retried != 0 {
+		t.Fatalf("Stats() returned %+v", stats)
+	}
+}
+
+func TestBulkWriterFlushesFullBuffer(t *testing.T) {
+
+	ctx := context.Background()
+	db, requests, stop := testBulkCluster(t)
+	defer stop()
+
+	w, err := db.NewBulkWriter(ctx, BulkOptions{FlushInterval: -1, Actions: 2})
+	if err != nil {
+		t.Fatalf("NewBulkWriter() failed: %v", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if err := w.Add(ctx, bulkResults(id, "clamav", "")); err != nil {
+			t.Fatalf("Add() failed: %v", err)
+		}
+	}
+	if expected := [][]string{{"a", "b"}}; !reflect.DeepEqual(requests(), expected) {
+		t.Fatalf("BulkWriter sent %v before Close(), expected %v", requests(), expected)
+	}
+	if err := w.Close(ctx); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	if expected := [][]string{{"a", "b"}, {"c"}}; !reflect.DeepEqual(requests(), expected) {
+		t.Fatalf("BulkWriter sent %v, expected %v", requests(), expected)
+	}
+}
@@ -0,0 +1,177 @@
+package elasticsearch
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthCheckPolicy controls when the connection to elasticsearch is verified before a write
+type HealthCheckPolicy int
+
+const (
+	// HealthCheckOnConnect pings elasticsearch once when the client is created (default)
+	HealthCheckOnConnect HealthCheckPolicy = iota
+	// HealthCheckAlways pings elasticsearch before every write
+	HealthCheckAlways
+	// HealthCheckNever never pings elasticsearch before writing
+	HealthCheckNever
+)
+
+const defaultMaxIdleConns = 32
+
+// connection returns the shared elasticsearch client applying the database's HealthCheck policy
+func (db *Database) connection(ctx context.Context) (*elastic.Client, error) {
+
+	client, created, err := db.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	if db.HealthCheck == HealthCheckAlways || (db.HealthCheck == HealthCheckOnConnect && created) {
+		if _, err := db.ping(ctx, client); err != nil {
+			if created {
+				// drop the client so the next call tries to connect again
+				db.Close()
+			}
+			return nil, errors.Wrap(err, "failed to connect to database")
+		}
+	}
+
+	return client, nil
+}
+
+// getClient returns the shared elasticsearch client creating it on first use.
+// NOTE: the connection settings (URL, credentials) are read when the client is created,
+// call Close to pick up changes.
+func (db *Database) getClient() (*elastic.Client, bool, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.client != nil {
+		return db.client, false, nil
+	}
+
+	// Create URL from host/port
+	db.getURL()
+	db.getTLS()
+	db.getCluster()
+
+	tlsConfig, err := db.tlsConfig()
+	if err != nil {
+		return nil, false, err
+	}
+	auth, err := db.authHeader()
+	if err != nil {
+		return nil, false, err
+	}
+
+	maxIdleConns := db.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+
+	db.transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	options := db.clusterOptions()
+
+	var transport http.RoundTripper = db.transport
+	if len(auth) > 0 {
+		// API keys and bearer tokens replace basic auth
+		transport = &headerTransport{
+			header: http.Header{"Authorization": []string{auth}},
+			base:   db.transport,
+		}
+	} else {
+		options = append(options, elastic.SetBasicAuth(
+			utils.Getopts(db.Username, "MALICE_ELASTICSEARCH_USERNAME", ""),
+			utils.Getopts(db.Password, "MALICE_ELASTICSEARCH_PASSWORD", ""),
+		))
+	}
+	options = append(options, elastic.SetHttpClient(&http.Client{Transport: transport}))
+
+	client, err := elastic.NewClient(options...)
+	if err != nil {
+		db.transport = nil
+		return nil, false, errors.Wrap(err, "failed to create elasticsearch client")
+	}
+
+	log.WithFields(log.Fields{
+		"url":         db.URL,
+		"sniff":       db.Sniff,
+		"healthcheck": db.HealthcheckInterval,
+	}).Debug("created elasticsearch client")
+
+	db.client = client
+
+	return client, true, nil
+}
+
+// ping pings the elasticsearch nodes until one answers to get e.g. the version number
+func (db *Database) ping(ctx context.Context, client *elastic.Client) (*elastic.PingResult, error) {
+
+	var err error
+	for _, u := range db.urls() {
+		log.Debugf("attempting to PING to: %s", u)
+		info, code, perr := client.Ping(u).Do(ctx)
+		if perr != nil {
+			log.WithField("url", u).WithError(perr).Debug("elasticsearch node is down")
+			err = perr
+			continue
+		}
+
+		db.setVersion(info.Version.Number)
+
+		log.WithFields(log.Fields{
+			"code":    code,
+			"cluster": info.ClusterName,
+			"version": info.Version.Number,
+			"url":     u,
+		}).Debug("elasticSearch connection successful")
+
+		return info, nil
+	}
+
+	if err == nil {
+		err = errors.New("no elasticsearch URL")
+	}
+
+	return nil, errors.Wrap(err, "failed to ping elasticsearch")
+}
+
+// Close stops the elasticsearch client and closes its pooled connections
+func (db *Database) Close() error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.client == nil {
+		return nil
+	}
+
+	db.client.Stop()
+	db.transport.CloseIdleConnections()
+
+	db.client = nil
+	db.transport = nil
+
+	return nil
+}
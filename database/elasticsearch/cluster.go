@@ -0,0 +1,77 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/olivere/elastic"
+)
+
+// urls returns the nodes of the comma-separated URL, e.g. "http://es1:9200,http://es2:9200"
+func (db *Database) urls() []string {
+	var urls []string
+	for _, u := range strings.Split(db.URL, ",") {
+		if u = strings.TrimSpace(u); len(u) > 0 {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// getCluster reads the cluster settings with the following order of precedence
+// - user input (cli)
+// - user ENV
+// - sane defaults
+func (db *Database) getCluster() {
+	if !db.Sniff {
+		db.Sniff, _ = strconv.ParseBool(utils.Getopt("MALICE_ELASTICSEARCH_SNIFF", "false"))
+	}
+	if db.HealthcheckInterval <= 0 {
+		db.HealthcheckInterval, _ = time.ParseDuration(utils.Getopt("MALICE_ELASTICSEARCH_HEALTHCHECK_INTERVAL", "0"))
+	}
+}
+
+// clusterOptions returns the client options of the nodes, sniffing and background health checks
+func (db *Database) clusterOptions() []elastic.ClientOptionFunc {
+
+	urls := db.urls()
+
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(urls...),
+		elastic.SetSniff(db.Sniff),
+		elastic.SetHealthcheck(db.HealthcheckInterval > 0),
+	}
+
+	if db.HealthcheckInterval > 0 {
+		options = append(options, elastic.SetHealthcheckInterval(db.HealthcheckInterval))
+	}
+
+	if db.Sniff && len(urls) > 0 {
+		// sniffed nodes are reached with the scheme of the configured ones
+		if u, err := url.Parse(urls[0]); err == nil && len(u.Scheme) > 0 {
+			options = append(options, elastic.SetScheme(u.Scheme))
+		}
+	}
+
+	if len(urls) > 1 || db.Sniff {
+		options = append(options, elastic.SetRetrier(failoverRetrier(len(urls))))
+	}
+
+	return options
+}
+
+// failoverRetrier retries requests that failed to reach a node on the next node
+// (nodes are picked round-robin, unreachable ones are skipped once marked dead)
+func failoverRetrier(nodes int) elastic.Retrier {
+	if nodes < 2 {
+		nodes = 2
+	}
+	return elastic.RetrierFunc(func(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+		return 0, retry < nodes, nil
+	})
+}
@@ -0,0 +1,247 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// hashFields are the file fields StoreHash stores intel lookups under
+var hashFields = []string{"md5", "sha1", "sha256", "sha512"}
+
+// maxCorrelated is the number of hash-only documents merged into a sample at once
+const maxCorrelated = 100
+
+// hashDoc is a document created by StoreHash
+type hashDoc struct {
+	id      string
+	index   string
+	plugins map[string]interface{}
+}
+
+// tombstoneScript marks a hash-only document as merged into a sample, plugin results
+// written to it afterwards are redirected to the sample (see pluginScript)
+const tombstoneScript = `ctx._source.merged_into = params.sample;`
+
+// correlatedScript writes plugin results written to a hash-only document after it was correlated into the sample
+const correlatedScript = `
+if (!(ctx._source.plugins instanceof Map)) { ctx._source.plugins = [:]; }
+for (category in params.plugins.entrySet()) {
+  if (!(ctx._source.plugins[category.getKey()] instanceof Map)) { ctx._source.plugins[category.getKey()] = [:]; }
+  ctx._source.plugins[category.getKey()].putAll(category.getValue());
+}
+`
+
+// correlate finds the hash-only documents created by StoreHash for any of the sample's
+// hashes and returns them with their plugin results merged oldest first.
+//
+// StoreHash returned the IDs of the documents to intel plugins, so once merged they are
+// kept as tombstones pointing at the sample (merged_into) and writes to them are redirected.
+func (db *Database) correlate(ctx context.Context, client *elastic.Client, id string, sample map[string]interface{}) ([]hashDoc, map[string]interface{}, error) {
+
+	query := elastic.NewBoolQuery().MustNot(elastic.NewIdsQuery().Ids(id), elastic.NewExistsQuery("merged_into"))
+	hashes := 0
+	for _, field := range hashFields {
+		hash, _ := sample[field].(string)
+		if len(hash) == 0 {
+			continue
+		}
+		query = query.Should(elastic.NewTermsQuery("file."+field, hash, strings.ToLower(hash)))
+		hashes++
+	}
+	if hashes == 0 {
+		return nil, nil, nil
+	}
+	query = query.MinimumNumberShouldMatch(1)
+
+	result, err := db.search(ctx, client, db.Index, elastic.NewSearchSource().
+		Query(query).
+		Sort("scan_date", true).
+		Size(maxCorrelated))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to search hash-only documents of sample with id: %s", id)
+	}
+	if result.Hits == nil {
+		return nil, nil, nil
+	}
+
+	var docs []hashDoc
+	plugins := make(map[string]interface{})
+
+	for _, hit := range result.Hits.Hits {
+		var source struct {
+			File    map[string]interface{} `json:"file"`
+			Plugins map[string]interface{} `json:"plugins"`
+		}
+		if hit.Source != nil {
+			if err := json.Unmarshal(*hit.Source, &source); err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to decode sample with id: %s", hit.Id)
+			}
+		}
+		// only merge intel lookups and not other samples sharing a hash
+		if !hashOnly(source.File) {
+			continue
+		}
+		docs = append(docs, hashDoc{id: hit.Id, index: hit.Index, plugins: source.Plugins})
+		database.Merge(plugins, source.Plugins)
+	}
+
+	if len(docs) == 0 {
+		return nil, nil, nil
+	}
+
+	return docs, plugins, nil
+}
+
+// hashOnly returns whether a document's file info only holds hashes
+func hashOnly(file map[string]interface{}) bool {
+	if len(file) == 0 {
+		return false
+	}
+	for key := range file {
+		if !utils.StringInSlice(key, hashFields) {
+			return false
+		}
+	}
+	return true
+}
+
+// tombstoneCorrelated replaces the hash-only documents merged into the sample with the given
+// ID by tombstones, results written to them after they were correlated are written to the sample
+func (db *Database) tombstoneCorrelated(ctx context.Context, client *elastic.Client, index, id string, docs []hashDoc) {
+
+	for _, doc := range docs {
+		fields := log.Fields{
+			"id":     doc.id,
+			"index":  doc.index,
+			"sample": id,
+		}
+		if err := db.tombstone(ctx, client, index, id, doc); err != nil {
+			log.WithFields(fields).WithError(err).Warn("failed to replace merged hash-only document with a tombstone")
+			continue
+		}
+		log.WithFields(fields).Debug("merged hash-only document into sample")
+	}
+}
+
+func (db *Database) tombstone(ctx context.Context, client *elastic.Client, index, id string, doc hashDoc) error {
+
+	fields := log.Fields{"op": "update", "index": doc.index, "id": doc.id}
+
+	// later writes to the document are redirected to the sample
+	script := elastic.NewScript(tombstoneScript).Lang("painless").Params(map[string]interface{}{"sample": id})
+	err := db.retry(ctx, fields, func() error {
+		_, err := db.update(ctx, client, doc.index, doc.id, script, nil)
+		return err
+	})
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// the results written before the document was marked are the last ones written to it
+	var get *elastic.GetResult
+	err = db.retry(ctx, log.Fields{"op": "get", "index": doc.index, "id": doc.id}, func() (err error) {
+		get, err = client.Get().
+			Index(doc.index).
+			Type(db.docType()).
+			Id(doc.id).
+			FetchSourceContext(elastic.NewFetchSourceContext(true).Include("plugins")).
+			Do(ctx)
+		return err
+	})
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+	if get != nil && get.Found && get.Source != nil {
+		var source struct {
+			Plugins map[string]interface{} `json:"plugins"`
+		}
+		if err := json.Unmarshal(*get.Source, &source); err != nil {
+			return errors.Wrapf(err, "failed to decode sample with id: %s", doc.id)
+		}
+		if changed := changedResults(doc.plugins, source.Plugins); len(changed) > 0 {
+			script := elastic.NewScript(correlatedScript).Lang("painless").Params(map[string]interface{}{"plugins": changed})
+			err := db.retry(ctx, log.Fields{"op": "update", "index": index, "id": id}, func() error {
+				_, err := db.update(ctx, client, index, id, script, nil)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to merge the late results of hash-only document %s", doc.id)
+			}
+		}
+	}
+
+	// the tombstone only points at the sample so searches do not find the merged results twice
+	return db.retry(ctx, log.Fields{"op": "index", "index": doc.index, "id": doc.id}, func() error {
+		_, err := client.Index().
+			Index(doc.index).
+			Type(db.docType()).
+			Id(doc.id).
+			BodyJson(map[string]interface{}{"merged_into": id}).
+			Do(ctx)
+		return err
+	})
+}
+
+// changedResults returns the plugin results of current that are not in previous
+func changedResults(previous, current map[string]interface{}) map[string]interface{} {
+
+	changed := make(map[string]interface{})
+	for category, plugins := range current {
+		plugins, ok := plugins.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		before, _ := previous[category].(map[string]interface{})
+		for name, data := range plugins {
+			if reflect.DeepEqual(before[name], data) {
+				continue
+			}
+			if _, ok := changed[category]; !ok {
+				changed[category] = make(map[string]interface{})
+			}
+			changed[category].(map[string]interface{})[name] = data
+		}
+	}
+
+	return changed
+}
+
+// mergedInto returns the ID of the sample the document was merged into (empty if it was not)
+func (db *Database) mergedInto(ctx context.Context, client *elastic.Client, index, id string) (string, error) {
+
+	get, err := client.Get().
+		Index(index).
+		Type(db.docType()).
+		Id(id).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("merged_into")).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get sample with id: %s", id)
+	}
+	if !get.Found || get.Source == nil {
+		return "", nil
+	}
+
+	var source struct {
+		MergedInto string `json:"merged_into"`
+	}
+	if err := json.Unmarshal(*get.Source, &source); err != nil {
+		return "", errors.Wrapf(err, "failed to decode sample with id: %s", id)
+	}
+
+	return source.MergedInto, nil
+}
@@ -0,0 +1,89 @@
+package elasticsearch
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+func TestChangedResults(t *testing.T) {
+
+	previous := map[string]interface{}{
+		"av": map[string]interface{}{
+			"clamav": map[string]interface{}{"result": "clean"},
+			"avast":  map[string]interface{}{"result": "clean"},
+		},
+	}
+	current := map[string]interface{}{
+		"av": map[string]interface{}{
+			"clamav": map[string]interface{}{"result": "clean"},
+			"avast":  map[string]interface{}{"result": "EICAR"},
+		},
+		"intel": map[string]interface{}{
+			"virustotal": map[string]interface{}{"positives": 3},
+		},
+	}
+
+	expected := map[string]interface{}{
+		"av": map[string]interface{}{
+			"avast": map[string]interface{}{"result": "EICAR"},
+		},
+		"intel": map[string]interface{}{
+			"virustotal": map[string]interface{}{"positives": 3},
+		},
+	}
+	if changed := changedResults(previous, current); !reflect.DeepEqual(changed, expected) {
+		t.Fatalf("changedResults() returned %v, expected %v", changed, expected)
+	}
+	if changed := changedResults(current, current); len(changed) != 0 {
+		t.Fatalf("changedResults() of the same results returned %v", changed)
+	}
+}
+
+func TestStorePluginResultsRedirectsTombstone(t *testing.T) {
+
+	var mu sync.Mutex
+	var updated []string
+
+	db, stop := testCluster(func(w http.ResponseWriter, r *http.Request, body []byte) {
+		switch {
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_update"):
+			id := strings.Split(r.URL.Path, "/")[3]
+			mu.Lock()
+			updated = append(updated, id)
+			mu.Unlock()
+			result := "updated"
+			if id == "hash" {
+				// pluginScript does not touch tombstones
+				result = "noop"
+			}
+			w.Write([]byte(`{"_index":"malice","_type":"samples","_id":"` + id + `","_version":2,"result":"` + result + `"}`))
+		case r.Method == "GET" && r.URL.Path == "/malice/samples/hash":
+			w.Write([]byte(`{"_index":"malice","_type":"samples","_id":"hash","_version":3,"found":true,"_source":{"merged_into":"sample"}}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer stop()
+
+	res, err := db.StorePluginResults(context.Background(), database.PluginResults{
+		ID:       "hash",
+		Category: "intel",
+		Name:     "virustotal",
+		Data:     map[string]interface{}{"positives": 3},
+	})
+	if err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	if res.ID != "sample" {
+		t.Fatalf("StorePluginResults() returned ID %s, expected the sample the document was merged into", res.ID)
+	}
+	if expected := []string{"hash", "sample"}; !reflect.DeepEqual(updated, expected) {
+		t.Fatalf("StorePluginResults() updated %v, expected %v", updated, expected)
+	}
+}
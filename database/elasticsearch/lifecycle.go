@@ -0,0 +1,275 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// IndexLifecycle manages the malice index as a write alias over indices that are
+// rolled over by age, size or document count and deleted after a retention period:
+//
+//	db := &elasticsearch.Database{
+//		Lifecycle: elasticsearch.IndexLifecycle{
+//			Enabled:    true,
+//			DateFormat: "yyyy.MM",           // malice-2026.10-000001
+//			MaxAge:     30 * 24 * time.Hour,
+//			MaxSize:    "50gb",
+//			Retention:  365 * 24 * time.Hour,
+//		},
+//	}
+//
+// Init installs an index template for <index>-*, bootstraps the first index
+// behind the <index> alias and calls Maintain which should also be run periodically.
+// Rolled over indices stay behind the alias, which requires elasticsearch 6.4+.
+type IndexLifecycle struct {
+	// Enabled turns Database.Index into a write alias over rolled over indices
+	Enabled bool `json:"enabled,omitempty"`
+	// DateFormat adds the rollover date to index names (a joda date format, e.g. "yyyy.MM")
+	DateFormat string `json:"date_format,omitempty"`
+	// MaxAge rolls the write index over once it is older
+	MaxAge time.Duration `json:"max_age,omitempty"`
+	// MaxDocs rolls the write index over once it holds more documents
+	MaxDocs int64 `json:"max_docs,omitempty"`
+	// MaxSize rolls the write index over once it is larger (elasticsearch byte units, e.g. "50gb")
+	MaxSize string `json:"max_size,omitempty"`
+	// Retention deletes the indices behind the alias once they were rolled over longer ago
+	Retention time.Duration `json:"retention,omitempty"`
+}
+
+// locate returns the concrete indices of the samples with the given IDs in a single
+// ids query, samples that do not exist yet are written to the write alias
+func (db *Database) locate(ctx context.Context, client *elastic.Client, ids ...string) (map[string]string, error) {
+
+	indices := make(map[string]string, len(ids))
+	for _, id := range ids {
+		indices[id] = db.Index
+	}
+	if !db.Lifecycle.Enabled || len(ids) == 0 {
+		return indices, nil
+	}
+
+	result, err := db.search(ctx, client, db.Index, elastic.NewSearchSource().
+		Query(elastic.NewIdsQuery().Ids(ids...)).
+		FetchSource(false).
+		Size(len(indices)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to locate %d samples", len(indices))
+	}
+	if result.Hits != nil {
+		for _, hit := range result.Hits.Hits {
+			indices[hit.Id] = hit.Index
+		}
+	}
+
+	return indices, nil
+}
+
+// writeAliasAction adds an index to the alias as its write index (elasticsearch 6.4+),
+// rolled over indices stay behind the alias so samples are read through it
+type writeAliasAction struct {
+	alias string
+	index string
+}
+
+// Source returns the JSON of the alias action
+func (a writeAliasAction) Source() (interface{}, error) {
+	return map[string]interface{}{
+		"add": map[string]interface{}{
+			"index":          a.index,
+			"alias":          a.alias,
+			"is_write_index": true,
+		},
+	}, nil
+}
+
+// initLifecycle installs the index template and bootstraps the write alias
+func (db *Database) initLifecycle(ctx context.Context, client *elastic.Client) error {
+
+	if err := db.putTemplate(ctx, client); err != nil {
+		return err
+	}
+
+	aliases, err := client.Aliases().Index(db.Index).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get aliases of: %s", db.Index)
+	}
+
+	if err == nil {
+		if _, ok := aliases.Indices[db.Index]; ok {
+			return errors.Errorf("%s is an index and not an alias, migrate it to use an index lifecycle", db.Index)
+		}
+		log.Debugf("write alias %s already exists", db.Index)
+		return db.Maintain(ctx)
+	}
+
+	create, err := client.CreateIndex(db.firstIndex()).
+		BodyJson(map[string]interface{}{
+			"aliases": map[string]interface{}{
+				db.Index: map[string]interface{}{"is_write_index": true},
+			},
+		}).
+		Do(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create index: %s", db.firstIndex())
+	}
+
+	log.WithFields(log.Fields{
+		"index": create.Index,
+		"alias": db.Index,
+	}).Debug("created write index")
+
+	return nil
+}
+
+// putTemplate installs the index template of the rolled over indices keeping the fields
+// and dynamic templates of the result types other plugins registered in the installed template
+func (db *Database) putTemplate(ctx context.Context, client *elastic.Client) error {
+
+	m := mapping()
+
+	installed, err := client.IndexGetTemplate(db.Index).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get index template: %s", db.Index)
+	}
+	if t, ok := installed[db.Index]; ok && t != nil {
+		m = mergeMapping(m, db.lookupMapping(map[string]interface{}{"mappings": t.Mappings}))
+	}
+
+	template, err := client.IndexPutTemplate(db.Index).
+		BodyJson(map[string]interface{}{
+			"index_patterns": []string{db.Index + "-*"},
+			"settings":       indexSettings,
+			"mappings":       db.mappings(m),
+		}).
+		Do(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put index template: %s", db.Index)
+	}
+	if !template.Acknowledged {
+		log.Error("index template not acknowledged")
+	}
+
+	return nil
+}
+
+// firstIndex returns the name of the first index behind the write alias
+func (db *Database) firstIndex() string {
+	if len(db.Lifecycle.DateFormat) > 0 {
+		return fmt.Sprintf("<%s-{now/d{%s}}-000001>", db.Index, db.Lifecycle.DateFormat)
+	}
+	return db.Index + "-000001"
+}
+
+// Maintain rolls the write index over if it meets any of the lifecycle's conditions
+// and deletes rolled over indices older than the retention period
+func (db *Database) Maintain(ctx context.Context) error {
+
+	if !db.Lifecycle.Enabled {
+		return nil
+	}
+
+	client, err := db.connection(ctx)
+	if err != nil {
+		return err
+	}
+
+	if db.Lifecycle.MaxAge > 0 || db.Lifecycle.MaxDocs > 0 || len(db.Lifecycle.MaxSize) > 0 {
+		rollover := client.RolloverIndex(db.Index)
+		if db.Lifecycle.MaxAge > 0 {
+			rollover = rollover.AddMaxIndexAgeCondition(fmt.Sprintf("%ds", int64(db.Lifecycle.MaxAge/time.Second)))
+		}
+		if db.Lifecycle.MaxDocs > 0 {
+			rollover = rollover.AddMaxIndexDocsCondition(db.Lifecycle.MaxDocs)
+		}
+		if len(db.Lifecycle.MaxSize) > 0 {
+			rollover = rollover.AddCondition("max_size", db.Lifecycle.MaxSize)
+		}
+
+		resp, err := rollover.Do(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "failed to roll over: %s", db.Index)
+		}
+		if resp.RolledOver {
+			log.WithFields(log.Fields{
+				"old_index":  resp.OldIndex,
+				"new_index":  resp.NewIndex,
+				"conditions": resp.Conditions,
+			}).Info("rolled over write index")
+		}
+	}
+
+	if db.Lifecycle.Retention > 0 {
+		return db.deleteExpired(ctx, client)
+	}
+
+	return nil
+}
+
+// deleteExpired deletes the indices behind the write alias that were rolled over before
+// the retention period, the write index has not been rolled over and is never deleted
+func (db *Database) deleteExpired(ctx context.Context, client *elastic.Client) error {
+
+	// the cluster state resolves the alias to its members and holds their rollover times
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/_cluster/state/metadata/" + url.PathEscape(db.Index),
+		Params: url.Values{"filter_path": []string{"metadata.indices.*.aliases,metadata.indices.*.rollover_info"}},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to get rollover info of: %s", db.Index)
+	}
+
+	var state struct {
+		Metadata struct {
+			Indices map[string]struct {
+				Aliases      []string `json:"aliases"`
+				RolloverInfo map[string]struct {
+					Time int64 `json:"time"`
+				} `json:"rollover_info"`
+			} `json:"indices"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(res.Body, &state); err != nil {
+		return errors.Wrapf(err, "failed to decode rollover info of: %s", db.Index)
+	}
+
+	indices := make([]string, 0, len(state.Metadata.Indices))
+	for index := range state.Metadata.Indices {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+
+	cutoff := time.Now().Add(-db.Lifecycle.Retention)
+
+	for _, index := range indices {
+		meta := state.Metadata.Indices[index]
+		if !utils.StringInSlice(db.Index, meta.Aliases) {
+			continue
+		}
+		rollover, ok := meta.RolloverInfo[db.Index]
+		if !ok {
+			continue
+		}
+		if time.Unix(0, rollover.Time*int64(time.Millisecond)).After(cutoff) {
+			continue
+		}
+		if _, err := client.DeleteIndex(index).Do(ctx); err != nil {
+			return errors.Wrapf(err, "failed to delete expired index: %s", index)
+		}
+		log.WithFields(log.Fields{
+			"index":       index,
+			"rolled_over": time.Unix(0, rollover.Time*int64(time.Millisecond)).UTC(),
+		}).Info("deleted expired index")
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPutTemplateKeepsOtherPlugins(t *testing.T) {
+
+	var put map[string]interface{}
+
+	db, stop := testCluster(func(w http.ResponseWriter, r *http.Request, body []byte) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/_template/malice":
+			w.Write([]byte(`{"malice":{"index_patterns":["malice-*"],"mappings":{"samples":{
+				"dynamic_templates":[{"plugins.exe.*.payload.machine":{"path_match":"plugins.exe.*.payload.machine","mapping":{"type":"keyword"}}}],
+				"properties":{"plugins":{"properties":{"exe":{"properties":{"pescan":{"properties":{"machine":{"type":"keyword"}}}}}}}}}}}}`))
+		case r.Method == "PUT" && r.URL.Path == "/_template/malice":
+			json.Unmarshal(body, &put)
+			w.Write([]byte(`{"acknowledged":true}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer stop()
+
+	client, err := db.connection(context.Background())
+	if err != nil {
+		t.Fatalf("connection() failed: %v", err)
+	}
+	if err := db.putTemplate(context.Background(), client); err != nil {
+		t.Fatalf("putTemplate() failed: %v", err)
+	}
+
+	m := db.lookupMapping(put)
+	if _, ok := lookupField(m, []string{"plugins", "exe", "pescan", "machine"}); !ok {
+		t.Fatalf("the installed template lost the fields of another plugin: %v", m["properties"])
+	}
+	if _, ok := lookupField(m, []string{"plugin_dates"}); !ok {
+		t.Fatal("the installed template does not have the current mapping")
+	}
+	if missing := missingFields(map[string]interface{}{
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{"plugin_dates": nil},
+			map[string]interface{}{"plugins.exe.*.payload.machine": nil},
+		},
+	}, m); len(missing) > 0 {
+		t.Fatalf("the installed template is missing the dynamic templates %v", missing)
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+
+	rolledOver := time.Now().Add(-48*time.Hour).UnixNano() / int64(time.Millisecond)
+	recent := time.Now().UnixNano() / int64(time.Millisecond)
+
+	var mu sync.Mutex
+	var deleted []string
+
+	db, stop := testCluster(func(w http.ResponseWriter, r *http.Request, body []byte) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/_cluster/state/metadata/malice":
+			fmt.Fprintf(w, `{"metadata":{"indices":{
+				"malice-000001":{"aliases":["malice"],"rollover_info":{"malice":{"time":%d}}},
+				"malice-000002":{"aliases":["malice"],"rollover_info":{"malice":{"time":%d}}},
+				"malice-000003":{"aliases":["malice"]},
+				"malice-v3-20260101":{"aliases":[]}}}}`, rolledOver, recent)
+		case r.Method == "DELETE":
+			mu.Lock()
+			deleted = append(deleted, r.URL.Path)
+			mu.Unlock()
+			w.Write([]byte(`{"acknowledged":true}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer stop()
+
+	db.Lifecycle = IndexLifecycle{Enabled: true, Retention: 24 * time.Hour}
+
+	if err := db.Maintain(context.Background()); err != nil {
+		t.Fatalf("Maintain() failed: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "/malice-000001" {
+		t.Fatalf("Maintain() deleted %v, expected only the index rolled over before the retention period", deleted)
+	}
+}
@@ -1,141 +1,443 @@
 package elasticsearch
 
-const mapping = `{
-  "settings": {
-    "number_of_shards": 1,
-    "number_of_replicas": 0
-  },
-  "mappings": {
-    "samples": {
-      "properties": {
-        "file": {
-          "properties": {
-            "md5": {
-              "type": "keyword"
-            },
-            "mime": {
-              "type": "keyword"
-            },
-            "name": {
-              "type": "keyword"
-            },
-            "path": {
-              "type": "text"
-            },
-            "sha1": {
-              "type": "keyword"
-            },
-            "sha256": {
-              "type": "keyword"
-            },
-            "sha512": {
-              "type": "keyword"
-            },
-            "size": {
-              "type": "keyword"
-            }
-          }
-        },
-        "plugins": {
-          "properties": {
-            "archive": {
-              "properties": {}
-            },
-            "av": {
-              "properties": {}
-            },
-            "document": {
-              "properties": {}
-            },
-            "exe": {
-              "properties": {}
-            },
-            "intel": {
-              "properties": {
-                "virustotal": {
-                  "dynamic": false,
-                  "properties": {}
-                }
-              }
-            },
-            "metadata": {
-              "properties": {}
-            }
-          }
-        },
-        "scan_date": {
-          "type": "date"
-        }
-      }
-    }
-  }
-}`
-
-// const mapping = `{
-//   "settings": {
-//     "number_of_shards": 1,
-//     "number_of_replicas": 0
-//   },
-//   "malice": {
-//     "mappings": {
-//       "samples": {
-//         "properties": {
-//           "file": {
-//             "properties": {
-//               "md5": {
-//                 "type": "text"
-//               },
-//               "mime": {
-//                 "type": "text"
-//               },
-//               "name": {
-//                 "type": "text"
-//               },
-//               "path": {
-//                 "type": "text"
-//               },
-//               "sha1": {
-//                 "type": "text"
-//               },
-//               "sha256": {
-//                 "type": "text"
-//               },
-//               "sha512": {
-//                 "type": "text"
-//               },
-//               "size": {
-//                 "type": "text"
-//               }
-//             }
-//           },
-//           "plugins": {
-//             "properties": {
-//               "archive": {
-//                 "type": "object"
-//               },
-//               "av": {
-//                 "type": "object"
-//               },
-//               "document": {
-//                 "type": "object"
-//               },
-//               "exe": {
-//                 "type": "object"
-//               },
-//               "intel": {
-//                 "type": "object"
-//               },
-//               "metadata": {
-//                 "type": "object"
-//               }
-//             }
-//           },
-//           "scan_date": {
-//             "type": "date",
-//             "format": "strict_date_optional_time||epoch_millis"
-//           }
-//         }
-//       }
-//     }
-//   }
-// }`
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+// MappingVersion is the version of the sample mapping, bump it when changing the base mapping
+const MappingVersion = 6
+
+// indexSettings are the settings of the indices created by Init
+var indexSettings = map[string]interface{}{
+	"number_of_shards":   1,
+	"number_of_replicas": 0,
+}
+
+// pluginCategories are always mapped even if no result types are registered for them
+var pluginCategories = []string{"archive", "av", "document", "exe", "intel", "metadata"}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// mapping returns the sample document mapping, plugin results are mapped from the
+// result types registered with database.RegisterResultType using their `es` struct tags:
+//
+//	type Results struct {
+//		_        struct{} `es:"dynamic=false"`  // only map the declared fields
+//		Infected bool     `json:"infected"`     // boolean
+//		Result   string   `json:"result"`       // text with a keyword sub-field
+//		Engine   string   `json:"engine" es:"keyword"`
+//		Raw      string   `json:"raw" es:"-"`   // not mapped
+//	}
+//
+// Types registered for a single plugin are mapped under plugins.<category>.<name>,
+// types registered for a category are mapped through dynamic templates as the
+// plugin names are not known up front (dynamic=false only applies to the former).
+//
+// The mapping_hash in _meta only covers the base mapping as every plugin registers
+// different result types, so they do not make the index mapping drift.
+func mapping() map[string]interface{} {
+
+	m := resultsMapping(database.ResultTypes())
+
+	m["_meta"] = map[string]interface{}{
+		"mapping_version": MappingVersion,
+		"mapping_hash":    mappingHash(resultsMapping(nil)),
+	}
+
+	return m
+}
+
+// resultsMapping returns the sample document mapping with the given result types
+func resultsMapping(types map[string]reflect.Type) map[string]interface{} {
+
+	plugins := make(map[string]interface{})
+	for _, category := range pluginCategories {
+		plugins[category] = map[string]interface{}{"properties": map[string]interface{}{}}
+	}
+	// virustotal reports contain thousands of fields
+	plugins["intel"].(map[string]interface{})["properties"] = map[string]interface{}{
+		"virustotal": map[string]interface{}{
+			"dynamic":    false,
+			"properties": map[string]interface{}{},
+		},
+	}
+
+	keys := make([]string, 0, len(types))
+	for key := range types {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// plugin_dates.<category>.<name> is when a plugin's results were last written
+	templates := []interface{}{
+		map[string]interface{}{
+			"plugin_dates": map[string]interface{}{
+				"path_match":         "plugin_dates.*",
+				"match_mapping_type": "string",
+				"mapping":            map[string]interface{}{"type": "date"},
+			},
+		},
+	}
+
+	for _, key := range keys {
+		parts := strings.SplitN(key, "/", 2)
+		category, name := parts[0], parts[1]
+
+		results := envelopeMapping(types[key])
+
+		if len(name) == 0 {
+			templates = append(templates, dynamicTemplates("plugins."+category+".*", results)...)
+			continue
+		}
+
+		if _, ok := plugins[category]; !ok {
+			plugins[category] = map[string]interface{}{"properties": map[string]interface{}{}}
+		}
+		plugins[category].(map[string]interface{})["properties"].(map[string]interface{})[name] = results
+	}
+
+	m := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"file": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"md5":    map[string]interface{}{"type": "keyword"},
+					"mime":   map[string]interface{}{"type": "keyword"},
+					"name":   map[string]interface{}{"type": "keyword"},
+					"path":   map[string]interface{}{"type": "text"},
+					"sha1":   map[string]interface{}{"type": "keyword"},
+					"sha256": map[string]interface{}{"type": "keyword"},
+					"sha512": map[string]interface{}{"type": "keyword"},
+					"size":   map[string]interface{}{"type": "keyword"},
+					// size in bytes parsed from size (see sizeBytes)
+					"size_bytes": map[string]interface{}{"type": "long"},
+				},
+			},
+			"plugins": map[string]interface{}{
+				"properties": plugins,
+			},
+			// the results appended by database.MergeAppend writes are kept but not indexed
+			"history": map[string]interface{}{
+				"type":    "object",
+				"enabled": false,
+			},
+			"plugin_dates": map[string]interface{}{"type": "object"},
+			// the sample a hash-only document was merged into (see correlate)
+			"merged_into": map[string]interface{}{"type": "keyword"},
+			"scan_date":   map[string]interface{}{"type": "date"},
+			"scans": map[string]interface{}{
+				"type": "nested",
+				"properties": map[string]interface{}{
+					"id":        map[string]interface{}{"type": "keyword"},
+					"scan_date": map[string]interface{}{"type": "date"},
+					"plugins":   map[string]interface{}{"type": "keyword"},
+				},
+			},
+		},
+	}
+	m["dynamic_templates"] = templates
+
+	return m
+}
+
+// mappingHash returns a hash of a mapping identifying changes of the base mapping
+func mappingHash(m map[string]interface{}) string {
+	// json sorts map keys so equal mappings have equal hashes
+	data, _ := json.Marshal(m)
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// envelopeMapping maps a database.Envelope with its payload of type payload
+func envelopeMapping(payload reflect.Type) map[string]interface{} {
+	results := typeMapping(reflect.TypeOf(database.Envelope{}), "")
+	results["properties"].(map[string]interface{})["payload"] = typeMapping(payload, "")
+	return results
+}
+
+// typeMapping returns the mapping of Go type t, es is the field's `es` struct tag
+func typeMapping(t reflect.Type, es string) map[string]interface{} {
+
+	opts := strings.Split(es, ",")
+	if esType := opts[0]; len(esType) > 0 {
+		if esType != "object" && esType != "nested" {
+			return map[string]interface{}{"type": esType}
+		}
+	}
+
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		if t.Kind() != reflect.Ptr && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "binary"}
+		}
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "date"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "long"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "double"}
+	case reflect.String:
+		// the same as elasticsearch's dynamic mapping of strings
+		return map[string]interface{}{
+			"type": "text",
+			"fields": map[string]interface{}{
+				"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+			},
+		}
+	case reflect.Struct:
+		return structMapping(t, opts)
+	case reflect.Map:
+		return map[string]interface{}{"type": "object"}
+	}
+
+	// interfaces are mapped dynamically
+	return nil
+}
+
+func structMapping(t reflect.Type, opts []string) map[string]interface{} {
+
+	properties := make(map[string]interface{})
+	for _, field := range database.JSONFields(t) {
+		es := field.Tag.Get("es")
+		if es == "-" {
+			continue
+		}
+		if fm := typeMapping(field.Type, es); fm != nil {
+			properties[database.JSONName(field)] = fm
+		}
+	}
+
+	m := map[string]interface{}{"properties": properties}
+
+	// struct level options are set on a blank field, e.g. _ struct{} `es:"dynamic=false"`
+	if blank, ok := t.FieldByName("_"); ok {
+		opts = append(opts, strings.Split(blank.Tag.Get("es"), ",")...)
+	}
+	for _, opt := range opts {
+		switch {
+		case opt == "nested":
+			m["type"] = "nested"
+		case strings.HasPrefix(opt, "dynamic="):
+			switch dynamic := strings.TrimPrefix(opt, "dynamic="); dynamic {
+			case "false":
+				m["dynamic"] = false
+			case "true":
+				m["dynamic"] = true
+			default:
+				m["dynamic"] = dynamic
+			}
+		}
+	}
+
+	return m
+}
+
+// dynamicTemplates maps the leaf fields of an object mapping at paths matching pattern
+func dynamicTemplates(pattern string, m map[string]interface{}) []interface{} {
+
+	properties, ok := m["properties"].(map[string]interface{})
+	if !ok {
+		return []interface{}{
+			map[string]interface{}{
+				pattern: map[string]interface{}{
+					"path_match": pattern,
+					"mapping":    m,
+				},
+			},
+		}
+	}
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var templates []interface{}
+	for _, name := range names {
+		templates = append(templates, dynamicTemplates(pattern+"."+name, properties[name].(map[string]interface{}))...)
+	}
+
+	return templates
+}
+
+// mergeTemplates returns the dynamic templates of m followed by the existing templates
+// of an index it does not define, elasticsearch replaces the whole list on a mapping update
+// so the templates of the result types other plugins registered would be dropped otherwise
+func mergeTemplates(m map[string]interface{}, existing []interface{}) map[string]interface{} {
+
+	templates, _ := m["dynamic_templates"].([]interface{})
+
+	names := make(map[string]bool)
+	for _, template := range templates {
+		for name := range template.(map[string]interface{}) {
+			names[name] = true
+		}
+	}
+
+	merged := append([]interface{}{}, templates...)
+	for _, template := range existing {
+		t, ok := template.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for name := range t {
+			if !names[name] {
+				names[name] = true
+				merged = append(merged, t)
+			}
+		}
+	}
+
+	m["dynamic_templates"] = merged
+	return m
+}
+
+// mergeMapping adds the fields of an existing mapping that m does not have to m and
+// merges their dynamic templates (see mergeTemplates), fields of m are kept as they are
+func mergeMapping(m, existing map[string]interface{}) map[string]interface{} {
+
+	var merge func(m, existing map[string]interface{})
+	merge = func(m, existing map[string]interface{}) {
+		if t, ok := m["type"].(string); ok && t != "object" && t != "nested" {
+			return
+		}
+		properties, ok := existing["properties"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		if _, ok := m["properties"].(map[string]interface{}); !ok {
+			m["properties"] = make(map[string]interface{})
+		}
+		for name, field := range properties {
+			fm, ok := m["properties"].(map[string]interface{})[name].(map[string]interface{})
+			if !ok {
+				m["properties"].(map[string]interface{})[name] = field
+				continue
+			}
+			if em, ok := field.(map[string]interface{}); ok {
+				merge(fm, em)
+			}
+		}
+	}
+	merge(m, existing)
+
+	templates, _ := existing["dynamic_templates"].([]interface{})
+	return mergeTemplates(m, templates)
+}
+
+// missingFields returns the fields and dynamic templates of mapping m that the
+// mapping of an index does not have (sorted)
+func missingFields(m, index map[string]interface{}) []string {
+
+	var missing []string
+
+	var walk func(m, index map[string]interface{}, prefix string)
+	walk = func(m, index map[string]interface{}, prefix string) {
+		properties, _ := m["properties"].(map[string]interface{})
+		existing, _ := index["properties"].(map[string]interface{})
+		for name, field := range properties {
+			fm, _ := field.(map[string]interface{})
+			im, ok := existing[name].(map[string]interface{})
+			if !ok {
+				missing = append(missing, prefix+name)
+				continue
+			}
+			walk(fm, im, prefix+name+".")
+		}
+	}
+	walk(m, index, "")
+
+	names := make(map[string]bool)
+	existing, _ := index["dynamic_templates"].([]interface{})
+	for _, template := range existing {
+		t, _ := template.(map[string]interface{})
+		for name := range t {
+			names[name] = true
+		}
+	}
+	templates, _ := m["dynamic_templates"].([]interface{})
+	for _, template := range templates {
+		for name := range template.(map[string]interface{}) {
+			if !names[name] {
+				missing = append(missing, "dynamic_templates."+name)
+			}
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}
+
+// keywordField returns the field to match exact string values of a field on in the
+// mapping m of the index: fields mapped as text are matched on their keyword sub-field,
+// other types (keyword, date, boolean, ...) on the field itself. Unmapped fields are
+// mapped as text with a keyword sub-field when strings are written to them.
+func keywordField(m map[string]interface{}, field string) string {
+
+	if fm, ok := lookupField(m, strings.Split(field, ".")); ok {
+		return textKeyword(fm, field)
+	}
+
+	templates, _ := m["dynamic_templates"].([]interface{})
+	for _, template := range templates {
+		t, ok := template.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, t := range t {
+			t, _ := t.(map[string]interface{})
+			pattern, _ := t["path_match"].(string)
+			if matched, _ := path.Match(pattern, field); matched {
+				fm, _ := t["mapping"].(map[string]interface{})
+				return textKeyword(fm, field)
+			}
+		}
+	}
+
+	return field + ".keyword"
+}
+
+// textKeyword returns the keyword sub-field of a field mapped as text
+func textKeyword(fm map[string]interface{}, field string) string {
+
+	if t, ok := fm["type"].(string); ok && t != "text" {
+		return field
+	}
+	if fields, ok := fm["fields"].(map[string]interface{}); ok {
+		if _, ok := fields["keyword"]; ok {
+			return field + ".keyword"
+		}
+	}
+
+	return field
+}
+
+func lookupField(m map[string]interface{}, names []string) (map[string]interface{}, bool) {
+	for _, name := range names {
+		properties, ok := m["properties"].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if m, ok = properties[name].(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return m, true
+}
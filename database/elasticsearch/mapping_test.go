@@ -0,0 +1,256 @@
+package elasticsearch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+type testSection struct {
+	Name    string  `json:"name" es:"keyword"`
+	Entropy float64 `json:"entropy"`
+}
+
+type testResults struct {
+	_        struct{}          `es:"dynamic=false"`
+	Infected bool              `json:"infected"`
+	Result   string            `json:"result"`
+	Engine   string            `json:"engine" es:"keyword"`
+	Raw      string            `json:"raw" es:"-"`
+	Count    int               `json:"count"`
+	Score    float64           `json:"score"`
+	Data     []byte            `json:"data"`
+	Seen     time.Time         `json:"seen"`
+	Updated  *time.Time        `json:"updated"`
+	Sections []testSection     `json:"sections" es:"nested"`
+	Tags     []string          `json:"tags"`
+	Meta     map[string]string `json:"meta"`
+	Any      interface{}       `json:"any"`
+}
+
+var textMapping = map[string]interface{}{
+	"type": "text",
+	"fields": map[string]interface{}{
+		"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+	},
+}
+
+func TestTypeMapping(t *testing.T) {
+
+	expected := map[string]interface{}{
+		"dynamic": false,
+		"properties": map[string]interface{}{
+			"infected": map[string]interface{}{"type": "boolean"},
+			"result":   textMapping,
+			"engine":   map[string]interface{}{"type": "keyword"},
+			"count":    map[string]interface{}{"type": "long"},
+			"score":    map[string]interface{}{"type": "double"},
+			"data":     map[string]interface{}{"type": "binary"},
+			"seen":     map[string]interface{}{"type": "date"},
+			"updated":  map[string]interface{}{"type": "date"},
+			"sections": map[string]interface{}{
+				"type": "nested",
+				"properties": map[string]interface{}{
+					"name":    map[string]interface{}{"type": "keyword"},
+					"entropy": map[string]interface{}{"type": "double"},
+				},
+			},
+			"tags": textMapping,
+			"meta": map[string]interface{}{"type": "object"},
+		},
+	}
+
+	if m := typeMapping(reflect.TypeOf(testResults{}), ""); !reflect.DeepEqual(m, expected) {
+		t.Fatalf("typeMapping() returned\n%v\nexpected\n%v", m, expected)
+	}
+}
+
+func TestResultsMapping(t *testing.T) {
+
+	m := resultsMapping(map[string]reflect.Type{
+		"exe/pescan": reflect.TypeOf(testSection{}),
+		"document/":  reflect.TypeOf(testSection{}),
+	})
+
+	pescan, ok := lookupField(m, []string{"plugins", "exe", "pescan"})
+	if !ok {
+		t.Fatal("plugins.exe.pescan is not mapped")
+	}
+	if expected := envelopeMapping(reflect.TypeOf(testSection{})); !reflect.DeepEqual(pescan, expected) {
+		t.Fatalf("plugins.exe.pescan is mapped as\n%v\nexpected\n%v", pescan, expected)
+	}
+	if payload, _ := lookupField(m, []string{"plugins", "exe", "pescan", "payload", "name"}); payload["type"] != "keyword" {
+		t.Fatalf("plugins.exe.pescan.payload.name is mapped as %v", payload)
+	}
+
+	templates := m["dynamic_templates"].([]interface{})
+	if _, ok := templates[0].(map[string]interface{})["plugin_dates"]; !ok {
+		t.Fatalf("the first dynamic template is %v, expected plugin_dates", templates[0])
+	}
+	expected := map[string]interface{}{
+		"plugins.document.*.payload.name": map[string]interface{}{
+			"path_match": "plugins.document.*.payload.name",
+			"mapping":    map[string]interface{}{"type": "keyword"},
+		},
+	}
+	found := false
+	for _, template := range templates {
+		if reflect.DeepEqual(template, expected) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("dynamic templates %v do not contain %v", templates, expected)
+	}
+
+	// every category is mapped even without result types
+	for _, category := range pluginCategories {
+		if _, ok := lookupField(resultsMapping(nil), []string{"plugins", category}); !ok {
+			t.Errorf("plugins.%s is not mapped", category)
+		}
+	}
+}
+
+func TestMappingHash(t *testing.T) {
+
+	meta := mapping()["_meta"].(map[string]interface{})
+	if meta["mapping_version"] != MappingVersion {
+		t.Fatalf("mapping_version is %v, expected %d", meta["mapping_version"], MappingVersion)
+	}
+	// registered result types differ between plugins and must not change the hash
+	if hash := mappingHash(resultsMapping(nil)); meta["mapping_hash"] != hash {
+		t.Fatalf("mapping_hash is %v, expected the hash of the base mapping %s", meta["mapping_hash"], hash)
+	}
+	if mappingHash(resultsMapping(nil)) != mappingHash(resultsMapping(nil)) {
+		t.Fatal("mappingHash() is not stable")
+	}
+}
+
+func TestMergeTemplates(t *testing.T) {
+
+	template := func(name string, mapping string) map[string]interface{} {
+		return map[string]interface{}{
+			name: map[string]interface{}{"path_match": name, "mapping": map[string]interface{}{"type": mapping}},
+		}
+	}
+
+	m := map[string]interface{}{
+		"dynamic_templates": []interface{}{template("plugin_dates", "date"), template("plugins.av.*.payload.engine", "keyword")},
+	}
+	existing := []interface{}{
+		template("plugin_dates", "keyword"),
+		template("plugins.exe.*.payload.machine", "keyword"),
+		"not a template",
+	}
+
+	expected := []interface{}{
+		template("plugin_dates", "date"),
+		template("plugins.av.*.payload.engine", "keyword"),
+		template("plugins.exe.*.payload.machine", "keyword"),
+	}
+
+	if merged := mergeTemplates(m, existing)["dynamic_templates"]; !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("mergeTemplates() returned\n%v\nexpected\n%v", merged, expected)
+	}
+}
+
+func TestMissingFields(t *testing.T) {
+
+	m := resultsMapping(map[string]reflect.Type{
+		"exe/pescan": reflect.TypeOf(testSection{}),
+		"document/":  reflect.TypeOf(testSection{}),
+	})
+
+	if missing := missingFields(m, m); len(missing) != 0 {
+		t.Fatalf("missingFields() of the same mapping returned %v", missing)
+	}
+
+	missing := missingFields(m, resultsMapping(nil))
+	// the envelope fields of the category's results are mapped by dynamic templates as well
+	expected := []string{
+		"dynamic_templates.plugins.document.*.category",
+		"dynamic_templates.plugins.document.*.duration",
+		"dynamic_templates.plugins.document.*.engine_version",
+		"dynamic_templates.plugins.document.*.error",
+		"dynamic_templates.plugins.document.*.payload.entropy",
+		"dynamic_templates.plugins.document.*.payload.name",
+		"dynamic_templates.plugins.document.*.plugin",
+		"dynamic_templates.plugins.document.*.plugin_version",
+		"dynamic_templates.plugins.document.*.schema_version",
+		"dynamic_templates.plugins.document.*.signature_date",
+		"dynamic_templates.plugins.document.*.status",
+		"plugins.exe.pescan",
+	}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Fatalf("missingFields() returned %v, expected %v", missing, expected)
+	}
+}
+
+func TestEnvelopeMapping(t *testing.T) {
+
+	m := envelopeMapping(reflect.TypeOf(database.AVResults{}))
+
+	for field, expected := range map[string]interface{}{
+		"schema_version":   "long",
+		"plugin":           "keyword",
+		"status":           "keyword",
+		"signature_date":   "date",
+		"payload.infected": "boolean",
+		"payload.engine":   "keyword",
+	} {
+		fm, ok := lookupField(m, strings.Split(field, "."))
+		if !ok || fm["type"] != expected {
+			t.Errorf("%s is mapped as %v, expected %s", field, fm, expected)
+		}
+	}
+}
+
+func TestKeywordField(t *testing.T) {
+
+	m := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"plugins": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"av": map[string]interface{}{
+						"properties": map[string]interface{}{
+							"clamav": map[string]interface{}{
+								"properties": map[string]interface{}{
+									"engine":   map[string]interface{}{"type": "keyword"},
+									"result":   textMapping,
+									"updated":  map[string]interface{}{"type": "date"},
+									"infected": map[string]interface{}{"type": "boolean"},
+									"raw":      map[string]interface{}{"type": "text"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		"dynamic_templates": []interface{}{
+			map[string]interface{}{
+				"plugins.av.*.payload.engine": map[string]interface{}{
+					"path_match": "plugins.av.*.payload.engine",
+					"mapping":    map[string]interface{}{"type": "keyword"},
+				},
+			},
+		},
+	}
+
+	for field, expected := range map[string]string{
+		"plugins.av.clamav.engine":         "plugins.av.clamav.engine",
+		"plugins.av.clamav.result":         "plugins.av.clamav.result.keyword",
+		"plugins.av.clamav.updated":        "plugins.av.clamav.updated",
+		"plugins.av.clamav.infected":       "plugins.av.clamav.infected",
+		"plugins.av.clamav.raw":            "plugins.av.clamav.raw",
+		"plugins.av.avast.payload.engine":  "plugins.av.avast.payload.engine",
+		"plugins.av.avast.payload.version": "plugins.av.avast.payload.version.keyword",
+	} {
+		if keywordField(m, field) != expected {
+			t.Errorf("keywordField(%s) returned %s, expected %s", field, keywordField(m, field), expected)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// MappingStatus compares the mapping stored in an index with the current mapping
+type MappingStatus struct {
+	Index string `json:"index"`
+	// Version and Hash are read from the index mapping's _meta (0 and empty for indices created before they were stored)
+	Version int    `json:"version"`
+	Hash    string `json:"hash,omitempty"`
+	// Drift is set if the index mapping is not the current mapping
+	Drift bool `json:"drift"`
+	// Missing are the fields and dynamic templates of the registered result types the index mapping does not have yet
+	Missing []string `json:"missing,omitempty"`
+}
+
+// CheckMapping compares the mapping of the indices behind Index with the current mapping
+func (db *Database) CheckMapping(ctx context.Context) ([]MappingStatus, error) {
+
+	client, err := db.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.checkMapping(ctx, client)
+}
+
+func (db *Database) checkMapping(ctx context.Context, client *elastic.Client) ([]MappingStatus, error) {
+
+	get := client.GetMapping().Index(db.Index)
+	if !db.typeless() {
+		get = get.Type(db.Type)
+	}
+	mappings, err := get.Do(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get mapping of: %s", db.Index)
+	}
+
+	current := mapping()
+	hash := current["_meta"].(map[string]interface{})["mapping_hash"]
+
+	var status []MappingStatus
+	for index, m := range mappings {
+		s := MappingStatus{Index: index}
+		s.Missing = missingFields(current, db.lookupMapping(m))
+		meta := db.lookupMeta(m)
+		if version, ok := meta["mapping_version"].(float64); ok {
+			s.Version = int(version)
+		}
+		s.Hash, _ = meta["mapping_hash"].(string)
+		s.Drift = s.Version != MappingVersion || s.Hash != hash
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Index < status[j].Index })
+
+	return status, nil
+}
+
+// mappingCacheTTL is how long the mapping of the indices is reused to build queries
+const mappingCacheTTL = time.Minute
+
+// getIndexMapping returns the mapping of the indices behind Index combined (the newest
+// index wins conflicting fields), the mapping is cached for mappingCacheTTL
+func (db *Database) getIndexMapping(ctx context.Context, client *elastic.Client) (map[string]interface{}, error) {
+
+	db.mappingMu.Lock()
+	defer db.mappingMu.Unlock()
+
+	if db.indexMapping != nil && time.Since(db.mappingFetched) < mappingCacheTTL {
+		return db.indexMapping, nil
+	}
+
+	get := client.GetMapping().Index(db.Index)
+	if !db.typeless() {
+		get = get.Type(db.Type)
+	}
+	mappings, err := get.Do(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get mapping of: %s", db.Index)
+	}
+
+	indices := make([]string, 0, len(mappings))
+	for index := range mappings {
+		indices = append(indices, index)
+	}
+	// rolled over indices sort before the ones that replaced them
+	sort.Sort(sort.Reverse(sort.StringSlice(indices)))
+
+	combined := make(map[string]interface{})
+	for _, index := range indices {
+		if m := db.lookupMapping(mappings[index]); m != nil {
+			combined = mergeMapping(combined, m)
+		}
+	}
+
+	db.indexMapping = combined
+	db.mappingFetched = time.Now()
+
+	return combined, nil
+}
+
+// lookupMeta returns the _meta of a get mapping response's index entry
+func (db *Database) lookupMeta(m interface{}) map[string]interface{} {
+	meta, _ := db.lookupMapping(m)["_meta"].(map[string]interface{})
+	return meta
+}
+
+// lookupMapping returns the sample mapping of a get mapping response's index entry
+func (db *Database) lookupMapping(m interface{}) map[string]interface{} {
+	index, _ := m.(map[string]interface{})
+	mappings, _ := index["mappings"].(map[string]interface{})
+	if !db.typeless() {
+		mappings, _ = mappings[db.Type].(map[string]interface{})
+	}
+	return mappings
+}
+
+// updateMapping detects mapping drift and result types registered after the index was
+// created at Init and applies the current mapping if it only adds fields, conflicting
+// changes require a Migrate
+func (db *Database) updateMapping(ctx context.Context, client *elastic.Client) error {
+
+	status, err := db.checkMapping(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range status {
+		if !s.Drift && len(s.Missing) == 0 {
+			continue
+		}
+
+		fields := log.Fields{
+			"index":           s.Index,
+			"mapping_version": s.Version,
+			"current_version": MappingVersion,
+			"missing":         len(s.Missing),
+		}
+
+		if err := db.putMapping(ctx, client, s.Index); err != nil {
+			log.WithFields(fields).WithError(err).Warn("index mapping is outdated and cannot be updated in place, run a migration")
+			continue
+		}
+
+		log.WithFields(fields).Info("updated index mapping")
+	}
+
+	return nil
+}
+
+// Migrate moves the samples to a new index with the current mapping. It creates
+// the index, copies the samples with the reindex API and then atomically points
+// the Index alias at the new index. The old index is kept for a rollback unless
+// Index was an index itself (created before migrations) which is replaced by the alias.
+//
+// With an index lifecycle Migrate rolls the write index over instead so new samples
+// are written with the current mapping and old indices expire with the retention period.
+//
+// Samples written while the reindex is running are not copied, stop the plugins first.
+func (db *Database) Migrate(ctx context.Context) (string, error) {
+
+	client, err := db.connection(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	aliases, err := client.Aliases().Index(db.Index).Do(ctx)
+	if err != nil && !(db.Lifecycle.Enabled && elastic.IsNotFound(err)) {
+		return "", errors.Wrapf(err, "failed to get aliases of: %s", db.Index)
+	}
+
+	var old []string
+	if aliases != nil {
+		for index := range aliases.Indices {
+			old = append(old, index)
+		}
+		sort.Strings(old)
+	}
+	// an index cannot have the name of an alias, so it has to be replaced
+	legacy := utils.StringInSlice(db.Index, old)
+
+	if db.Lifecycle.Enabled && !legacy {
+		if err := db.initLifecycle(ctx, client); err != nil {
+			return "", err
+		}
+		if aliases == nil {
+			// the write alias was just created with the current mapping
+			return db.firstIndex(), nil
+		}
+		resp, err := client.RolloverIndex(db.Index).Do(ctx)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to roll over: %s", db.Index)
+		}
+		log.WithFields(log.Fields{
+			"old_index": resp.OldIndex,
+			"new_index": resp.NewIndex,
+		}).Info("rolled over write index to migrate its mapping")
+		return resp.NewIndex, nil
+	}
+
+	index := fmt.Sprintf("%s-v%d-%s", db.Index, MappingVersion, time.Now().UTC().Format("20060102150405"))
+	create := client.CreateIndex(index).BodyJson(db.indexBody())
+	if db.Lifecycle.Enabled {
+		// the first index of the lifecycle gets its settings and mapping from the template
+		if err := db.putTemplate(ctx, client); err != nil {
+			return "", err
+		}
+		index = db.firstIndex()
+		create = client.CreateIndex(index)
+	}
+
+	created, err := create.Do(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create index: %s", index)
+	}
+	if len(created.Index) > 0 {
+		// resolves date math index names
+		index = created.Index
+	}
+
+	log.WithFields(log.Fields{
+		"from": old,
+		"to":   index,
+	}).Info("reindexing samples")
+
+	resp, err := client.Reindex().
+		SourceIndex(db.Index).
+		DestinationIndex(index).
+		Refresh("true").
+		WaitForCompletion(true).
+		Do(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to reindex %s into %s", db.Index, index)
+	}
+	if len(resp.Failures) > 0 {
+		return "", errors.Errorf("failed to reindex %d of %d samples into %s", len(resp.Failures), resp.Total, index)
+	}
+
+	var actions []elastic.AliasAction
+	if db.Lifecycle.Enabled {
+		actions = append(actions, writeAliasAction{alias: db.Index, index: index})
+	} else {
+		actions = append(actions, elastic.NewAliasAddAction(db.Index).Index(index))
+	}
+	for _, o := range old {
+		if o == db.Index {
+			actions = append(actions, elastic.NewAliasRemoveIndexAction(o))
+		} else {
+			actions = append(actions, elastic.NewAliasRemoveAction(db.Index).Index(o))
+		}
+	}
+
+	if _, err := client.Alias().Action(actions...).Do(ctx); err != nil {
+		return "", errors.Wrapf(err, "failed to point alias %s at %s", db.Index, index)
+	}
+
+	log.WithFields(log.Fields{
+		"alias":    db.Index,
+		"index":    index,
+		"samples":  resp.Created,
+		"took_ms":  resp.Took,
+		"previous": old,
+	}).Info("migrated samples")
+
+	return index, nil
+}
@@ -0,0 +1,217 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+// make sure elasticsearch.Database satisfies the database.Querier interface
+var _ database.Querier = (*Database)(nil)
+
+// GetSample returns the sample with the given ID
+func (db *Database) GetSample(ctx context.Context, id string) (*database.Sample, error) {
+
+	client, err := db.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	indices, err := db.locate(ctx, client, id)
+	if err != nil {
+		return nil, err
+	}
+	index := indices[id]
+
+	get, err := client.Get().
+		Index(index).
+		Type(db.docType()).
+		Id(id).
+		Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil, errors.Wrapf(database.ErrNotFound, "sample with id %s", id)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get sample with id: %s", id)
+	}
+	if !get.Found {
+		return nil, errors.Wrapf(database.ErrNotFound, "sample with id %s", id)
+	}
+
+	var version int64
+	if get.Version != nil {
+		version = *get.Version
+	}
+
+	// hash-only documents merged into a sample are tombstones pointing at it
+	if get.Source != nil {
+		var tombstone struct {
+			MergedInto string `json:"merged_into"`
+		}
+		if err := json.Unmarshal(*get.Source, &tombstone); err == nil && len(tombstone.MergedInto) > 0 && tombstone.MergedInto != id {
+			return db.GetSample(ctx, tombstone.MergedInto)
+		}
+	}
+
+	sample, err := newSample(get.Id, version, get.Index, get.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sample, nil
+}
+
+// FindByHash returns all samples with the given md5, sha1, sha256 or sha512 (newest first)
+func (db *Database) FindByHash(ctx context.Context, hash string) ([]database.Sample, error) {
+	return db.ListScans(ctx, database.ScanFilter{Hash: hash})
+}
+
+// GetPluginResults returns the results of a plugin for the sample with the given ID
+func (db *Database) GetPluginResults(ctx context.Context, id, category, name string) (map[string]interface{}, error) {
+
+	sample, err := db.GetSample(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := sample.PluginResults(category, name)
+	if !ok {
+		return nil, errors.Wrapf(database.ErrNotFound, "results of plugin %s/%s for sample with id %s", category, name, id)
+	}
+
+	return data, nil
+}
+
+// ListScans returns the samples matching filter (newest first)
+func (db *Database) ListScans(ctx context.Context, filter database.ScanFilter) ([]database.Sample, error) {
+
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	client, err := db.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = database.DefaultScanLimit
+	}
+
+	// exact string values are matched on the fields' keyword sub-fields in the index mapping
+	var m map[string]interface{}
+	if len(filter.Category) > 0 && len(filter.Fields) > 0 {
+		if m, err = db.getIndexMapping(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := db.search(ctx, client, db.Index, elastic.NewSearchSource().
+		Query(scanQuery(filter, m)).
+		Sort("scan_date", false).
+		Size(limit).
+		Version(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search samples")
+	}
+
+	return searchSamples(result)
+}
+
+// scanQuery translates a ScanFilter into a query on the keyword fields of the index mapping m
+func scanQuery(filter database.ScanFilter, m map[string]interface{}) elastic.Query {
+
+	// tombstones of merged hash-only documents are not samples
+	query := elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("merged_into"))
+
+	if len(filter.Hash) > 0 {
+		hashType, _ := utils.GetHashType(filter.Hash)
+		query = query.Filter(elastic.NewTermsQuery("file."+hashType, filter.Hash, strings.ToLower(filter.Hash)))
+	}
+
+	if len(filter.Category) > 0 {
+		field := "plugins." + filter.Category
+		if len(filter.Name) > 0 {
+			field += "." + filter.Name
+		}
+		query = query.Filter(elastic.NewExistsQuery(field))
+
+		// sorted so the same filter always builds the same query
+		keys := make([]string, 0, len(filter.Fields))
+		for key := range filter.Fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			query = query.Filter(fieldQuery(m, field+"."+key, filter.Fields[key]))
+		}
+
+		if !filter.ResultsSince.IsZero() {
+			query = query.Filter(elastic.NewRangeQuery("plugin_dates." + filter.Category + "." + filter.Name).
+				Gte(filter.ResultsSince))
+		}
+	}
+
+	if !filter.Since.IsZero() || !filter.Until.IsZero() {
+		scanDate := elastic.NewRangeQuery("scan_date")
+		if !filter.Since.IsZero() {
+			scanDate = scanDate.Gte(filter.Since)
+		}
+		if !filter.Until.IsZero() {
+			scanDate = scanDate.Lte(filter.Until)
+		}
+		query = query.Filter(scanDate)
+	}
+
+	return query
+}
+
+// fieldQuery matches a plugin result field exactly, strings mapped as text
+// are matched on their keyword sub-field in the index mapping m
+func fieldQuery(m map[string]interface{}, field string, value interface{}) elastic.Query {
+	if s, ok := value.(string); ok {
+		return elastic.NewTermQuery(keywordField(m, field), s)
+	}
+	return elastic.NewTermQuery(field, value)
+}
+
+func searchSamples(result *elastic.SearchResult) ([]database.Sample, error) {
+
+	if result.Hits == nil {
+		return nil, nil
+	}
+
+	samples := make([]database.Sample, 0, len(result.Hits.Hits))
+	for _, hit := range result.Hits.Hits {
+		var version int64
+		if hit.Version != nil {
+			version = *hit.Version
+		}
+		sample, err := newSample(hit.Id, version, hit.Index, hit.Source)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+func newSample(id string, version int64, index string, source *json.RawMessage) (database.Sample, error) {
+
+	var doc map[string]interface{}
+	if source != nil {
+		if err := json.Unmarshal(*source, &doc); err != nil {
+			return database.Sample{}, errors.Wrapf(err, "failed to decode sample with id: %s", id)
+		}
+	}
+
+	return database.NewSample(id, version, index, doc), nil
+}
@@ -0,0 +1,157 @@
+package elasticsearch
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetryMaxAttempts    = 5
+	defaultRetryInitialBackoff = 100 * time.Millisecond
+	defaultRetryMaxBackoff     = 10 * time.Second
+)
+
+// defaultRetriableStatus are the HTTP statuses of an overloaded or restarting cluster
+var defaultRetriableStatus = []int{429, 502, 503, 504}
+
+// RetryPolicy controls how writes that failed with a retriable error are retried.
+// Connection errors are always retriable, the zero value uses the defaults.
+type RetryPolicy struct {
+	// MaxAttempts is how often a write is sent before its error is returned (default 5, 1 disables retries)
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// InitialBackoff is the wait before the first retry, it doubles with every attempt (default 100ms)
+	InitialBackoff time.Duration `json:"initial_backoff,omitempty"`
+	// MaxBackoff caps the wait between two attempts (default 10s)
+	MaxBackoff time.Duration `json:"max_backoff,omitempty"`
+	// RetriableStatus are the HTTP statuses that are retried (default 429, 502, 503 and 504)
+	RetriableStatus []int `json:"retriable_status,omitempty"`
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// Next returns the wait before the given retry (starting at 1): an exponential
+// backoff with jitter so clients do not retry in lockstep. It implements elastic.Backoff.
+func (p RetryPolicy) Next(retry int) (time.Duration, bool) {
+
+	if retry >= p.maxAttempts() {
+		return 0, false
+	}
+
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+
+	wait := time.Duration(math.Min(float64(initial)*math.Pow(2, float64(retry-1)), float64(max)))
+	// "equal jitter": wait at least half of the backoff
+	wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+
+	return wait, true
+}
+
+// retriable returns whether a failed request should be retried
+func (p RetryPolicy) retriable(err error) bool {
+	err = errors.Cause(err)
+	// the http client wraps the context's error
+	if e, ok := err.(*url.Error); ok && (e.Err == context.Canceled || e.Err == context.DeadlineExceeded) {
+		return false
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	if e, ok := err.(*elastic.Error); ok {
+		return p.retriableStatus(e.Status)
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return elastic.IsConnErr(err)
+}
+
+// retriableStatus returns whether a request that failed with the given HTTP status should be retried
+func (p RetryPolicy) retriableStatus(status int) bool {
+	statuses := p.RetriableStatus
+	if len(statuses) == 0 {
+		statuses = defaultRetriableStatus
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// unapplied returns whether a write that failed with err was certainly not applied so a
+// write that is not idempotent can be retried, a timeout or a 502, 503 or 504 response
+// can be returned after elasticsearch applied the write
+func (p RetryPolicy) unapplied(err error) bool {
+	if !p.retriable(err) {
+		return false
+	}
+	err = errors.Cause(err)
+	if e, ok := err.(*elastic.Error); ok {
+		return e.Status == http.StatusTooManyRequests
+	}
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	if e, ok := err.(*net.OpError); ok {
+		// the request was not sent
+		return e.Op == "dial"
+	}
+	return elastic.IsConnErr(err)
+}
+
+// retry calls write until it succeeds, fails with an error that is not retriable
+// or the attempts of the database's RetryPolicy are used up
+func (db *Database) retry(ctx context.Context, fields log.Fields, write func() error) error {
+	return db.retryIf(ctx, fields, db.Retry.retriable, write)
+}
+
+// retryIf is retry with the errors that are retried decided by retriable
+func (db *Database) retryIf(ctx context.Context, fields log.Fields, retriable func(error) bool, write func() error) error {
+
+	for attempt := 1; ; attempt++ {
+
+		err := write()
+		if err == nil || !retriable(err) {
+			return err
+		}
+
+		wait, ok := db.Retry.Next(attempt)
+		if !ok {
+			log.WithFields(fields).WithField("attempts", attempt).WithError(err).Warn("elasticsearch write failed, giving up")
+			return err
+		}
+
+		log.WithFields(fields).WithFields(log.Fields{
+			"attempt": attempt,
+			"backoff": wait,
+		}).WithError(err).Info("elasticsearch write failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package elasticsearch
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+	pkgerrors "github.com/pkg/errors"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryPolicyNext(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		retry  int
+		min    time.Duration
+		max    time.Duration
+		ok     bool
+	}{
+		{"first retry", RetryPolicy{}, 1, 50 * time.Millisecond, 100 * time.Millisecond, true},
+		{"doubles", RetryPolicy{}, 3, 200 * time.Millisecond, 400 * time.Millisecond, true},
+		{"capped", RetryPolicy{MaxAttempts: 20, MaxBackoff: time.Second}, 10, 500 * time.Millisecond, time.Second, true},
+		{"initial backoff", RetryPolicy{InitialBackoff: time.Second}, 2, time.Second, 2 * time.Second, true},
+		{"last attempt", RetryPolicy{}, 4, 400 * time.Millisecond, 800 * time.Millisecond, true},
+		{"attempts used up", RetryPolicy{}, 5, 0, 0, false},
+		{"retries disabled", RetryPolicy{MaxAttempts: 1}, 1, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 100; i++ {
+				wait, ok := test.policy.Next(test.retry)
+				if ok != test.ok {
+					t.Fatalf("Next(%d) returned ok=%v, expected %v", test.retry, ok, test.ok)
+				}
+				if wait < test.min || wait > test.max {
+					t.Fatalf("Next(%d) returned %s, expected between %s and %s", test.retry, wait, test.min, test.max)
+				}
+				seen[wait] = true
+			}
+			// the jitter spreads the waits of clients retrying at the same time
+			if test.ok && len(seen) < 2 {
+				t.Fatalf("Next(%d) always returned %v", test.retry, seen)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyRetriableStatus(t *testing.T) {
+
+	tests := []struct {
+		policy RetryPolicy
+		status int
+		want   bool
+	}{
+		{RetryPolicy{}, 429, true},
+		{RetryPolicy{}, 502, true},
+		{RetryPolicy{}, 503, true},
+		{RetryPolicy{}, 504, true},
+		{RetryPolicy{}, 400, false},
+		{RetryPolicy{}, 404, false},
+		{RetryPolicy{}, 409, false},
+		{RetryPolicy{}, 500, false},
+		{RetryPolicy{RetriableStatus: []int{500}}, 500, true},
+		{RetryPolicy{RetriableStatus: []int{500}}, 503, false},
+	}
+
+	for _, test := range tests {
+		if got := test.policy.retriableStatus(test.status); got != test.want {
+			t.Errorf("retriableStatus(%d) with %v returned %v, expected %v", test.status, test.policy.RetriableStatus, got, test.want)
+		}
+	}
+}
+
+func TestRetryPolicyRetriable(t *testing.T) {
+
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+
+	tests := []struct {
+		name      string
+		err       error
+		retriable bool
+		unapplied bool
+	}{
+		{"too many requests", &elastic.Error{Status: 429}, true, true},
+		{"bad gateway", &elastic.Error{Status: 502}, true, false},
+		{"unavailable", &elastic.Error{Status: 503}, true, false},
+		{"gateway timeout", &elastic.Error{Status: 504}, true, false},
+		{"bad request", &elastic.Error{Status: 400}, false, false},
+		{"conflict", &elastic.Error{Status: 409}, false, false},
+		{"wrapped status", pkgerrors.Wrap(&elastic.Error{Status: 429}, "bulk request failed"), true, true},
+		{"dial", dial, true, true},
+		{"dial through the http client", &url.Error{Op: "Post", URL: "http://localhost:9200", Err: dial}, true, true},
+		{"read", read, true, false},
+		{"read through the http client", &url.Error{Op: "Post", URL: "http://localhost:9200", Err: read}, true, false},
+		{"timeout", timeoutError{}, true, false},
+		{"no node available", elastic.ErrNoClient, true, true},
+		{"canceled", context.Canceled, false, false},
+		{"deadline", context.DeadlineExceeded, false, false},
+		{"wrapped deadline", pkgerrors.Wrap(context.DeadlineExceeded, "failed"), false, false},
+		{"deadline through the http client", &url.Error{Op: "Post", URL: "http://localhost:9200", Err: context.DeadlineExceeded}, false, false},
+		{"other", errors.New("boom"), false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := (RetryPolicy{}).retriable(test.err); got != test.retriable {
+				t.Errorf("retriable(%v) returned %v, expected %v", test.err, got, test.retriable)
+			}
+			if got := (RetryPolicy{}).unapplied(test.err); got != test.unapplied {
+				t.Errorf("unapplied(%v) returned %v, expected %v", test.err, got, test.unapplied)
+			}
+		})
+	}
+}
+
+func TestRetryStopsOnCanceledContext(t *testing.T) {
+
+	db := &Database{Retry: RetryPolicy{InitialBackoff: time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	err := db.retry(ctx, nil, func() error {
+		attempts++
+		cancel()
+		return &elastic.Error{Status: 503}
+	})
+	if attempts != 1 {
+		t.Fatalf("retry() made %d attempts after the context was canceled", attempts)
+	}
+	if e, ok := err.(*elastic.Error); !ok || e.Status != 503 {
+		t.Fatalf("retry() returned %v, expected the last error", err)
+	}
+}
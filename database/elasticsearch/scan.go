@@ -0,0 +1,218 @@
+package elasticsearch
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/olivere/elastic"
+)
+
+// A sample is stored once with its sha256 as document ID. Every StoreFileInfo
+// records a scan in the sample's scans and the plugins that store results
+// afterwards are added to the latest scan, so re-scans keep the history:
+//
+//	{
+//	  "file": {"sha256": "...", ...},
+//	  "plugins": {"av": {"clamav": {...}}},
+//	  "scan_date": "2026-10-18T08:00:00Z",
+//	  "scans": [
+//	    {"id": "5f1c...", "scan_date": "2026-10-01T08:00:00Z", "plugins": ["av/clamav"]},
+//	    {"id": "9a2e...", "scan_date": "2026-10-18T08:00:00Z", "plugins": ["av/clamav"]}
+//	  ]
+//	}
+
+// mergeFunction merges objects recursively like a partial document update (see database.Merge)
+const mergeFunction = `
+void merge(Map dst, Map src) {
+  for (entry in src.entrySet()) {
+    def old = dst.get(entry.getKey());
+    if (old instanceof Map && entry.getValue() instanceof Map) {
+      merge(old, entry.getValue());
+    } else {
+      dst.put(entry.getKey(), entry.getValue());
+    }
+  }
+}
+`
+
+// scanScript records a scan of an existing sample and merges the plugin results
+// of correlated hash-only documents, a retried update does not record the scan twice
+const scanScript = mergeFunction + `
+if (!(ctx._source.file instanceof Map)) { ctx._source.file = [:]; }
+ctx._source.file.putAll(params.file);
+ctx._source.scan_date = params.scan.scan_date;
+if (!(ctx._source.scans instanceof List)) { ctx._source.scans = []; }
+boolean recorded = false;
+for (def scan : ctx._source.scans) {
+  if (scan instanceof Map && scan.id == params.scan.id) { recorded = true; }
+}
+if (!recorded) { ctx._source.scans.add(params.scan); }
+if (params.plugins instanceof Map) {
+  if (!(ctx._source.plugins instanceof Map)) { ctx._source.plugins = [:]; }
+  merge(ctx._source.plugins, params.plugins);
+}
+`
+
+// pluginScript writes plugin results into a sample with the results' merge strategy
+// (see database.StoreResults) and adds the plugin to the sample's latest scan, the
+// results are not written to the tombstone of a merged hash-only document (see correlate)
+const pluginScript = mergeFunction + `
+if (ctx._source.merged_into != null) {
+  ctx.op = 'none';
+} else {
+  ctx._source.scan_date = params.scan_date;
+  if (!(ctx._source.plugin_dates instanceof Map)) { ctx._source.plugin_dates = [:]; }
+  if (!(ctx._source.plugin_dates[params.category] instanceof Map)) { ctx._source.plugin_dates[params.category] = [:]; }
+  ctx._source.plugin_dates[params.category][params.name] = params.scan_date;
+  if (!(ctx._source.plugins instanceof Map)) { ctx._source.plugins = [:]; }
+  if (!(ctx._source.plugins[params.category] instanceof Map)) { ctx._source.plugins[params.category] = [:]; }
+  def plugins = ctx._source.plugins[params.category];
+  if (params.strategy == 'merge' && plugins[params.name] instanceof Map && params.data instanceof Map) {
+    merge(plugins[params.name], params.data);
+  } else {
+    plugins[params.name] = params.data;
+  }
+  if (params.strategy == 'append') {
+    if (!(ctx._source.history instanceof Map)) { ctx._source.history = [:]; }
+    if (!(ctx._source.history[params.category] instanceof Map)) { ctx._source.history[params.category] = [:]; }
+    def history = ctx._source.history[params.category];
+    if (!(history[params.name] instanceof List)) { history[params.name] = []; }
+    history[params.name].add(params.entry);
+  }
+  if (ctx._source.scans instanceof List && !ctx._source.scans.isEmpty()) {
+    def scan = ctx._source.scans.get(ctx._source.scans.size() - 1);
+    if (!(scan.plugins instanceof List)) { scan.plugins = []; }
+    if (!scan.plugins.contains(params.plugin)) { scan.plugins.add(params.plugin); }
+  }
+}
+`
+
+// scanEvent returns a new scan of a sample
+func scanEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"id":        database.NewID(),
+		"scan_date": time.Now().Format(time.RFC3339Nano),
+		"plugins":   []string{},
+	}
+}
+
+// fileScript returns the script recording a scan of the sample and the document
+// created if the sample does not exist yet, plugins are the results of correlated
+// hash-only documents (nil if there are none)
+func (db *Database) fileScript(sample, scan, plugins map[string]interface{}) (*elastic.Script, map[string]interface{}) {
+
+	// file.size is a humanized string like "12 kB" so the byte count is stored for range queries
+	if size, ok := sizeBytes(sample["size"]); ok {
+		file := make(map[string]interface{}, len(sample)+1)
+		for key, value := range sample {
+			file[key] = value
+		}
+		file["size_bytes"] = size
+		sample = file
+	}
+
+	doc := map[string]interface{}{
+		"file":      sample,
+		"scan_date": scan["scan_date"],
+		"scans":     []interface{}{scan},
+	}
+	if len(db.Plugins) > 0 || len(plugins) > 0 {
+		placeholder := make(map[string]interface{})
+		database.Merge(placeholder, database.CopyValue(db.Plugins).(map[string]interface{}))
+		database.Merge(placeholder, plugins)
+		doc["plugins"] = placeholder
+	}
+
+	params := map[string]interface{}{
+		"file": sample,
+		"scan": scan,
+	}
+	if len(plugins) > 0 {
+		params["plugins"] = plugins
+	}
+
+	script := elastic.NewScript(scanScript).
+		Lang("painless").
+		Params(params)
+
+	return script, doc
+}
+
+// byteUnits are the units of humanized sizes (e.g. go-humanize's Bytes and IBytes)
+var byteUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"pb":  1e15,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+	"pib": 1 << 50,
+}
+
+// sizeBytes returns the number of bytes of a file size, humanized sizes are rounded
+func sizeBytes(size interface{}) (int64, bool) {
+
+	switch size := size.(type) {
+	case int:
+		return int64(size), true
+	case int64:
+		return size, true
+	case uint64:
+		return int64(size), true
+	case float64:
+		return int64(size), true
+	case string:
+		size = strings.TrimSpace(size)
+		i := strings.IndexFunc(size, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		if i < 0 {
+			i = len(size)
+		}
+		value, err := strconv.ParseFloat(size[:i], 64)
+		if err != nil {
+			return 0, false
+		}
+		unit, ok := byteUnits[strings.ToLower(strings.TrimSpace(size[i:]))]
+		if !ok {
+			return 0, false
+		}
+		return int64(value*unit + 0.5), true
+	}
+
+	return 0, false
+}
+
+// resultsScript returns the script storing a plugin's results and the document
+// created if the sample does not exist yet
+func resultsScript(results database.PluginResults) (*elastic.Script, map[string]interface{}) {
+
+	scanDate := time.Now().Format(time.RFC3339Nano)
+
+	doc := make(map[string]interface{})
+	database.StoreResults(doc, results, scanDate)
+
+	strategy := results.Merge
+	if len(strategy) == 0 {
+		strategy = database.MergeReplace
+	}
+
+	script := elastic.NewScript(pluginScript).
+		Lang("painless").
+		Params(map[string]interface{}{
+			"scan_date": scanDate,
+			"category":  results.Category,
+			"name":      results.Name,
+			"data":      results.Data,
+			"strategy":  string(strategy),
+			"entry":     database.HistoryDoc(results, scanDate),
+			"plugin":    results.Category + "/" + results.Name,
+		})
+
+	return script, doc
+}
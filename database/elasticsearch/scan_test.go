@@ -0,0 +1,37 @@
+package elasticsearch
+
+import "testing"
+
+func TestSizeBytes(t *testing.T) {
+
+	tests := []struct {
+		size     interface{}
+		expected int64
+		ok       bool
+	}{
+		{68, 68, true},
+		{int64(1 << 40), 1 << 40, true},
+		{uint64(512), 512, true},
+		{float64(1024), 1024, true},
+		{"68", 68, true},
+		{"68 B", 68, true},
+		{" 1.5 kB ", 1500, true},
+		{"2.3 MB", 2300000, true},
+		{"1 GB", 1000000000, true},
+		{"1.5 KiB", 1536, true},
+		{"2 MiB", 2 << 20, true},
+		{"0.1 B", 0, true},
+		{"12 parsecs", 0, false},
+		{"MB", 0, false},
+		{"", 0, false},
+		{nil, 0, false},
+		{true, 0, false},
+	}
+
+	for _, tt := range tests {
+		size, ok := sizeBytes(tt.size)
+		if size != tt.expected || ok != tt.ok {
+			t.Errorf("sizeBytes(%#v) returned %d, %v, expected %d, %v", tt.size, size, ok, tt.expected, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package elasticsearch
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+// Query builds a search of the samples with typed filters and aggregations:
+//
+//	// all samples any AV flagged infected in the last 7 days with the top 20 detection names
+//	res, err := db.NewQuery().
+//		Since(7 * 24 * time.Hour).
+//		Infected("av").
+//		Limit(50).
+//		TopDetections(20).
+//		Do(ctx)
+//
+// Filters are combined with AND, plugin names may be "*" to match any plugin of a category.
+type Query struct {
+	db    *Database
+	query *elastic.BoolQuery
+	limit int
+	err   error
+
+	// fields are filters on plugin result fields resolved against the index mapping in Do
+	fields []func(m map[string]interface{}) elastic.Query
+
+	detections    bool
+	topDetections int
+	mimes         int
+	scansPerDay   bool
+}
+
+// SearchResult is the result of a Query
+type SearchResult struct {
+	// Total is the number of matching samples
+	Total int64 `json:"total"`
+	// Samples are the matching samples (newest first) up to the query's limit
+	Samples []database.Sample `json:"samples,omitempty"`
+	// Detections are the detection counts per AV engine (DetectionsPerEngine)
+	Detections []EngineDetections `json:"detections,omitempty"`
+	// TopDetections are the most frequent detection names (TopDetections, the counts are approximate)
+	TopDetections []TermCount `json:"top_detections,omitempty"`
+	// Mimes is the mime type histogram (MimeHistogram)
+	Mimes []TermCount `json:"mimes,omitempty"`
+	// ScansPerDay are the scans recorded in the scan histories per day (ScansPerDay)
+	ScansPerDay []DateCount `json:"scans_per_day,omitempty"`
+}
+
+// EngineDetections counts the matching samples scanned and flagged by an AV engine
+type EngineDetections struct {
+	Engine   string `json:"engine"`
+	Scanned  int64  `json:"scanned"`
+	Infected int64  `json:"infected"`
+}
+
+// TermCount is a bucket of a terms aggregation
+type TermCount struct {
+	Term  string `json:"term"`
+	Count int64  `json:"count"`
+}
+
+// DateCount is a bucket of a date histogram
+type DateCount struct {
+	Date  time.Time `json:"date"`
+	Count int64     `json:"count"`
+}
+
+// NewQuery returns a Query matching all samples
+func (db *Database) NewQuery() *Query {
+	return &Query{
+		db: db,
+		// tombstones of merged hash-only documents are not samples
+		query: elastic.NewBoolQuery().MustNot(elastic.NewExistsQuery("merged_into")),
+		limit: database.DefaultScanLimit,
+	}
+}
+
+// ScanDate matches samples last scanned between from and to (a zero time is unbounded)
+func (q *Query) ScanDate(from, to time.Time) *Query {
+	scanDate := elastic.NewRangeQuery("scan_date")
+	if !from.IsZero() {
+		scanDate = scanDate.Gte(from)
+	}
+	if !to.IsZero() {
+		scanDate = scanDate.Lte(to)
+	}
+	q.query = q.query.Filter(scanDate)
+	return q
+}
+
+// Since matches samples last scanned within d
+func (q *Query) Since(d time.Duration) *Query {
+	return q.ScanDate(time.Now().Add(-d), time.Time{})
+}
+
+// Hash matches samples with the given md5, sha1, sha256 or sha512
+func (q *Query) Hash(hash string) *Query {
+	hashType, err := utils.GetHashType(hash)
+	if err != nil {
+		return q.fail(errors.Wrapf(err, "unable to detect hash type: %s", hash))
+	}
+	q.query = q.query.Filter(elastic.NewTermsQuery("file."+hashType, hash, strings.ToLower(hash)))
+	return q
+}
+
+// Mime matches samples with any of the given mime types
+func (q *Query) Mime(mimes ...string) *Query {
+	values := make([]interface{}, len(mimes))
+	for i, mime := range mimes {
+		values[i] = mime
+	}
+	q.query = q.query.Filter(elastic.NewTermsQuery("file.mime", values...))
+	return q
+}
+
+// FileSize matches samples with a size in bytes between min and max (0 is unbounded),
+// samples stored before file.size_bytes was mapped are not matched
+func (q *Query) FileSize(min, max int64) *Query {
+	size := elastic.NewRangeQuery("file.size_bytes").Gte(min)
+	if max > 0 {
+		size = size.Lte(max)
+	}
+	q.query = q.query.Filter(size)
+	return q
+}
+
+// File matches samples whose file.<field> equals value
+func (q *Query) File(field string, value interface{}) *Query {
+	field = "file." + field
+	if fm, ok := lookupField(mapping(), strings.Split(field, ".")); ok && fm["type"] == "text" {
+		q.query = q.query.Filter(elastic.NewMatchPhraseQuery(field, value))
+		return q
+	}
+	q.query = q.query.Filter(elastic.NewTermQuery(field, value))
+	return q
+}
+
+// Plugin matches samples with results of the plugin
+func (q *Query) Plugin(category, name string) *Query {
+	field := "plugins." + category
+	if len(name) > 0 && name != "*" {
+		field += "." + name
+	}
+	q.query = q.query.Filter(elastic.NewExistsQuery(field))
+	return q
+}
+
+// PluginField matches samples whose plugins.<category>.<name>.<field> equals value,
+// e.g. PluginField("av", "*", "payload.engine", "0.100.1")
+func (q *Query) PluginField(category, name, field string, value interface{}) *Query {
+	q.fields = append(q.fields, func(m map[string]interface{}) elastic.Query {
+		return pluginFieldQuery(m, category, name, field, value)
+	})
+	return q
+}
+
+// Infected matches samples flagged infected by any plugin of the category, the flag is
+// read from results stored as a database.Envelope (see database.AVResults) or plain results
+func (q *Query) Infected(category string) *Query {
+	q.query = q.query.Filter(elastic.NewBoolQuery().
+		Should(
+			pluginFieldQuery(nil, category, "*", "payload.infected", true),
+			pluginFieldQuery(nil, category, "*", "infected", true),
+		).
+		MinimumNumberShouldMatch(1))
+	return q
+}
+
+func pluginFieldQuery(m map[string]interface{}, category, name, field string, value interface{}) elastic.Query {
+
+	if name != "*" {
+		return fieldQuery(m, fmt.Sprintf("plugins.%s.%s.%s", category, name, field), value)
+	}
+
+	// term queries do not expand wildcard field names, query_string does
+	return elastic.NewQueryStringQuery(fmt.Sprintf("%q", fmt.Sprint(value))).
+		Field(fmt.Sprintf("plugins.%s.*.%s", category, field)).
+		Lenient(true)
+}
+
+// Limit sets the number of samples returned (default database.DefaultScanLimit, 0 only returns aggregations)
+func (q *Query) Limit(limit int) *Query {
+	q.limit = limit
+	return q
+}
+
+// DetectionsPerEngine counts the matching samples scanned and flagged infected per AV engine
+func (q *Query) DetectionsPerEngine() *Query {
+	q.detections = true
+	return q
+}
+
+// TopDetections returns the size most frequent detection names of all AV engines.
+// The counts are approximate: they are the sums of each engine's size most frequent
+// names, a name below an engine's top size is not counted for that engine and a
+// sample flagged with the same name by several engines is counted once per engine.
+func (q *Query) TopDetections(size int) *Query {
+	q.topDetections = size
+	return q
+}
+
+// MimeHistogram returns the size most frequent mime types
+func (q *Query) MimeHistogram(size int) *Query {
+	q.mimes = size
+	return q
+}
+
+// ScansPerDay returns the number of scans per day recorded in the scan histories of the matching samples
+func (q *Query) ScansPerDay() *Query {
+	q.scansPerDay = true
+	return q
+}
+
+func (q *Query) fail(err error) *Query {
+	if q.err == nil {
+		q.err = err
+	}
+	return q
+}
+
+// Do runs the query
+func (q *Query) Do(ctx context.Context) (*SearchResult, error) {
+
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	client, err := q.db.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]interface{}
+	if len(q.fields) > 0 || q.detections || q.topDetections > 0 {
+		if m, err = q.db.getIndexMapping(ctx, client); err != nil {
+			return nil, err
+		}
+	}
+
+	query := q.query
+	if len(q.fields) > 0 {
+		// the builder's query is not changed so the Query can be run again
+		query = elastic.NewBoolQuery().Filter(q.query)
+		for _, field := range q.fields {
+			query = query.Filter(field(m))
+		}
+	}
+
+	source := elastic.NewSearchSource().
+		Query(query).
+		Sort("scan_date", false).
+		Size(q.limit).
+		Version(true)
+
+	var engines []string
+	if q.detections || q.topDetections > 0 {
+		engines = pluginNames(m, "av")
+	}
+
+	for _, engine := range engines {
+		// results are stored as a database.Envelope or plain results
+		field := "plugins.av." + engine
+		infected := elastic.NewFilterAggregation().Filter(elastic.NewBoolQuery().
+			Should(
+				elastic.NewTermQuery(field+".payload.infected", true),
+				elastic.NewTermQuery(field+".infected", true),
+			).
+			MinimumNumberShouldMatch(1))
+		if q.topDetections > 0 {
+			infected = infected.
+				SubAggregation("names", elastic.NewTermsAggregation().
+					Field(keywordField(m, field+".payload.result")).
+					Size(q.topDetections)).
+				SubAggregation("plain_names", elastic.NewTermsAggregation().
+					Field(keywordField(m, field+".result")).
+					Size(q.topDetections))
+		}
+		source = source.Aggregation("engine:"+engine, elastic.NewFilterAggregation().
+			Filter(elastic.NewExistsQuery("plugins.av."+engine)).
+			SubAggregation("infected", infected))
+	}
+
+	if q.mimes > 0 {
+		source = source.Aggregation("mimes", elastic.NewTermsAggregation().Field("file.mime").Size(q.mimes))
+	}
+
+	if q.scansPerDay {
+		source = source.Aggregation("scans", elastic.NewNestedAggregation().
+			Path("scans").
+			SubAggregation("days", q.db.dailyHistogram("scans.scan_date")))
+	}
+
+	result, err := q.db.search(ctx, client, q.db.Index, source)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to search samples")
+	}
+
+	res := &SearchResult{}
+	if result.Hits != nil {
+		res.Total = result.Hits.TotalHits
+	}
+	if res.Samples, err = searchSamples(result); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]int64)
+	for _, engine := range engines {
+		agg, ok := result.Aggregations.Filter("engine:" + engine)
+		if !ok {
+			continue
+		}
+		detections := EngineDetections{Engine: engine, Scanned: agg.DocCount}
+		if infected, ok := agg.Filter("infected"); ok {
+			detections.Infected = infected.DocCount
+			for _, agg := range []string{"names", "plain_names"} {
+				if terms, ok := infected.Terms(agg); ok {
+					for _, bucket := range terms.Buckets {
+						names[fmt.Sprint(bucket.Key)] += bucket.DocCount
+					}
+				}
+			}
+		}
+		if q.detections {
+			res.Detections = append(res.Detections, detections)
+		}
+	}
+	if q.detections {
+		sort.Slice(res.Detections, func(i, j int) bool {
+			if res.Detections[i].Infected != res.Detections[j].Infected {
+				return res.Detections[i].Infected > res.Detections[j].Infected
+			}
+			return res.Detections[i].Engine < res.Detections[j].Engine
+		})
+	}
+	if q.topDetections > 0 {
+		res.TopDetections = topTerms(names, q.topDetections)
+	}
+
+	if terms, ok := result.Aggregations.Terms("mimes"); ok {
+		for _, bucket := range terms.Buckets {
+			res.Mimes = append(res.Mimes, TermCount{Term: fmt.Sprint(bucket.Key), Count: bucket.DocCount})
+		}
+	}
+
+	if scans, ok := result.Aggregations.Nested("scans"); ok {
+		if days, ok := scans.DateHistogram("days"); ok {
+			for _, bucket := range days.Buckets {
+				res.ScansPerDay = append(res.ScansPerDay, DateCount{
+					Date:  time.Unix(0, int64(bucket.Key)*int64(time.Millisecond)).UTC(),
+					Count: bucket.DocCount,
+				})
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// topTerms returns the size terms with the highest counts
+func topTerms(counts map[string]int64, size int) []TermCount {
+
+	terms := make([]TermCount, 0, len(counts))
+	for term, count := range counts {
+		terms = append(terms, TermCount{Term: term, Count: count})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Count != terms[j].Count {
+			return terms[i].Count > terms[j].Count
+		}
+		return terms[i].Term < terms[j].Term
+	})
+	if len(terms) > size {
+		terms = terms[:size]
+	}
+
+	return terms
+}
+
+// rawAggregation is an aggregation the client cannot build
+type rawAggregation map[string]interface{}
+
+// Source implements elastic.Aggregation
+func (a rawAggregation) Source() (interface{}, error) {
+	return map[string]interface{}(a), nil
+}
+
+// dailyHistogram returns a date histogram with a bucket per day,
+// elasticsearch 7+ replaced interval with calendar_interval
+func (db *Database) dailyHistogram(field string) elastic.Aggregation {
+	interval := "interval"
+	if db.typeless() {
+		interval = "calendar_interval"
+	}
+	return rawAggregation{
+		"date_histogram": map[string]interface{}{
+			"field":         field,
+			interval:        "day",
+			"min_doc_count": 1,
+		},
+	}
+}
+
+// pluginNames returns the names of the plugins of a category in the mapping m of the indices samples are read from
+func pluginNames(m map[string]interface{}, category string) []string {
+
+	plugins, _ := lookupField(m, []string{"plugins", category})
+	properties, _ := plugins["properties"].(map[string]interface{})
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
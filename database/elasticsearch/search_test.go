@@ -0,0 +1,164 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+// jsonEqual decodes the JSON of actual and expected and compares them
+func jsonEqual(t *testing.T, actual interface{}, expected string) bool {
+	t.Helper()
+
+	raw, err := json.Marshal(actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a, e interface{}
+	if err := json.Unmarshal(raw, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	return reflect.DeepEqual(a, e)
+}
+
+func TestScanQuery(t *testing.T) {
+
+	since := time.Date(2018, 9, 17, 0, 0, 0, 0, time.UTC)
+	m := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"plugins": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"av": map[string]interface{}{
+						"properties": map[string]interface{}{
+							"clamav": map[string]interface{}{
+								"properties": map[string]interface{}{
+									"engine": map[string]interface{}{"type": "keyword"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	source, err := scanQuery(database.ScanFilter{
+		Hash:         "ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789",
+		Category:     "av",
+		Name:         "clamav",
+		Fields:       map[string]interface{}{"engine": "0.100.1", "infected": true, "result": "EICAR"},
+		ResultsSince: since,
+		Since:        since,
+	}, m).Source()
+	if err != nil {
+		t.Fatalf("Source() failed: %v", err)
+	}
+
+	expected := `{"bool": {
+		"filter": [
+			{"terms": {"file.sha256": [
+				"ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789",
+				"abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789"]}},
+			{"exists": {"field": "plugins.av.clamav"}},
+			{"term": {"plugins.av.clamav.engine": "0.100.1"}},
+			{"term": {"plugins.av.clamav.infected": true}},
+			{"term": {"plugins.av.clamav.result.keyword": "EICAR"}},
+			{"range": {"plugin_dates.av.clamav": {"from": "2018-09-17T00:00:00Z", "include_lower": true, "include_upper": true, "to": null}}},
+			{"range": {"scan_date": {"from": "2018-09-17T00:00:00Z", "include_lower": true, "include_upper": true, "to": null}}}
+		],
+		"must_not": {"exists": {"field": "merged_into"}}
+	}}`
+	if !jsonEqual(t, source, expected) {
+		raw, _ := json.Marshal(source)
+		t.Fatalf("scanQuery() returned\n%s\nexpected\n%s", raw, expected)
+	}
+}
+
+func TestQueryDo(t *testing.T) {
+
+	var search map[string]interface{}
+
+	db, stop := testCluster(func(w http.ResponseWriter, r *http.Request, body []byte) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/malice/_mapping/samples":
+			w.Write([]byte(`{"malice":{"mappings":{"samples":{"properties":{"plugins":{"properties":{"av":{"properties":{
+				"clamav":{"properties":{"result":{"type":"text","fields":{"keyword":{"type":"keyword"}}}}},
+				"avast":{"properties":{"payload":{"properties":{"result":{"type":"keyword"}}}}}}}}}}}}}}`))
+		case strings.HasSuffix(r.URL.Path, "/_search"):
+			if err := json.Unmarshal(body, &search); err != nil {
+				t.Errorf("invalid search: %v", err)
+			}
+			w.Write([]byte(`{"hits":{"total":3,"hits":[]},"aggregations":{
+				"engine:avast":{"doc_count":3,"infected":{"doc_count":2,
+					"names":{"buckets":[{"key":"EICAR","doc_count":2}]},
+					"plain_names":{"buckets":[]}}},
+				"engine:clamav":{"doc_count":2,"infected":{"doc_count":1,
+					"names":{"buckets":[]},
+					"plain_names":{"buckets":[{"key":"Eicar-Signature","doc_count":1},{"key":"EICAR","doc_count":1}]}}}}}`))
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL)
+		}
+	})
+	defer stop()
+
+	res, err := db.NewQuery().
+		Mime("text/plain").
+		PluginField("av", "clamav", "result", "EICAR").
+		Limit(0).
+		DetectionsPerEngine().
+		TopDetections(1).
+		Do(context.Background())
+	if err != nil {
+		t.Fatalf("Do() failed: %v", err)
+	}
+
+	expected := `{"bool": {
+		"filter": [
+			{"bool": {
+				"filter": {"terms": {"file.mime": ["text/plain"]}},
+				"must_not": {"exists": {"field": "merged_into"}}
+			}},
+			{"term": {"plugins.av.clamav.result.keyword": "EICAR"}}
+		]
+	}}`
+	if !jsonEqual(t, search["query"], expected) {
+		raw, _ := json.Marshal(search["query"])
+		t.Fatalf("Do() searched\n%s\nexpected\n%s", raw, expected)
+	}
+
+	aggs, _ := search["aggregations"].(map[string]interface{})
+	names := func(engine, agg string) interface{} {
+		a, _ := aggs["engine:"+engine].(map[string]interface{})
+		a, _ = a["aggregations"].(map[string]interface{})
+		a, _ = a["infected"].(map[string]interface{})
+		a, _ = a["aggregations"].(map[string]interface{})
+		a, _ = a[agg].(map[string]interface{})
+		a, _ = a["terms"].(map[string]interface{})
+		return a["field"]
+	}
+	for _, agg := range []struct{ engine, agg, field string }{
+		{"avast", "names", "plugins.av.avast.payload.result"},
+		{"clamav", "plain_names", "plugins.av.clamav.result.keyword"},
+	} {
+		if field := names(agg.engine, agg.agg); field != agg.field {
+			t.Errorf("Do() aggregated the %s of %s on %v, expected %s", agg.agg, agg.engine, field, agg.field)
+		}
+	}
+
+	if expected := []EngineDetections{{Engine: "avast", Scanned: 3, Infected: 2}, {Engine: "clamav", Scanned: 2, Infected: 1}}; !reflect.DeepEqual(res.Detections, expected) {
+		t.Fatalf("Do() returned detections %+v, expected %+v", res.Detections, expected)
+	}
+	if expected := []TermCount{{Term: "EICAR", Count: 3}}; !reflect.DeepEqual(res.TopDetections, expected) {
+		t.Fatalf("Do() returned top detections %+v, expected %+v", res.TopDetections, expected)
+	}
+}
@@ -0,0 +1,174 @@
+package elasticsearch
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+	"github.com/pkg/errors"
+)
+
+// typelessVersion is the first elasticsearch major version without mapping types
+const typelessVersion = 7
+
+// typelessDocType is the document type of the typeless index, get and update endpoints
+const typelessDocType = "_doc"
+
+// majorVersion returns the configured MajorVersion or the one detected by the last ping
+// (0 if the cluster has not been pinged yet)
+func (db *Database) majorVersion() int {
+	if db.MajorVersion > 0 {
+		return db.MajorVersion
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.detectedVersion
+}
+
+// typeless returns whether the cluster rejects mapping types (elasticsearch 7+)
+func (db *Database) typeless() bool {
+	return db.majorVersion() >= typelessVersion
+}
+
+// docType returns the document type of index, get and update requests
+func (db *Database) docType() string {
+	if db.typeless() {
+		return typelessDocType
+	}
+	return db.Type
+}
+
+// mappings returns the mappings of an index with mapping m, nested under Type on clusters with mapping types
+func (db *Database) mappings(m map[string]interface{}) map[string]interface{} {
+	if db.typeless() {
+		return m
+	}
+	return map[string]interface{}{
+		db.Type: m,
+	}
+}
+
+// indexBody returns the settings and mappings of a new malice index
+func (db *Database) indexBody() map[string]interface{} {
+	return map[string]interface{}{
+		"settings": indexSettings,
+		"mappings": db.mappings(mapping()),
+	}
+}
+
+// setVersion stores the major version of a ping's version number, e.g. "6.8.23"
+func (db *Database) setVersion(number string) {
+	major, err := strconv.Atoi(strings.SplitN(number, ".", 2)[0])
+	if err != nil {
+		return
+	}
+	db.mu.Lock()
+	db.detectedVersion = major
+	db.mu.Unlock()
+}
+
+// search runs a search on index, elasticsearch 7+ returns the total hits as an object
+// the client cannot decode, so they are requested as an integer instead
+func (db *Database) search(ctx context.Context, client *elastic.Client, index string, source *elastic.SearchSource) (*elastic.SearchResult, error) {
+
+	if !db.typeless() {
+		return client.Search().Index(index).Type(db.Type).SearchSource(source).Do(ctx)
+	}
+
+	body, err := source.Source()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + url.PathEscape(index) + "/_search",
+		Params: url.Values{"rest_total_hits_as_int": []string{"true"}},
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(elastic.SearchResult)
+	if err := json.Unmarshal(res.Body, result); err != nil {
+		return nil, errors.Wrap(err, "failed to decode search result")
+	}
+
+	return result, nil
+}
+
+// update runs script on the document with the given ID or creates it from upsert,
+// elasticsearch 7+ moved the update endpoint to /{index}/_update/{id}
+func (db *Database) update(ctx context.Context, client *elastic.Client, index, id string, script *elastic.Script, upsert interface{}) (*elastic.UpdateResponse, error) {
+
+	if !db.typeless() {
+		return client.Update().
+			Index(index).
+			Type(db.Type).
+			Id(id).
+			Script(script).
+			Upsert(upsert).
+			RetryOnConflict(retryOnConflict).
+			Do(ctx)
+	}
+
+	source, err := script.Source()
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]interface{}{"script": source}
+	if upsert != nil {
+		body["upsert"] = upsert
+	}
+
+	res, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/" + url.PathEscape(index) + "/_update/" + url.PathEscape(id),
+		Params: url.Values{"retry_on_conflict": []string{strconv.Itoa(retryOnConflict)}},
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	update := new(elastic.UpdateResponse)
+	if err := json.Unmarshal(res.Body, update); err != nil {
+		return nil, errors.Wrap(err, "failed to decode update response")
+	}
+
+	return update, nil
+}
+
+// putMapping updates the mapping of index keeping the dynamic templates it already has,
+// elasticsearch 7+ has no type in the endpoint
+func (db *Database) putMapping(ctx context.Context, client *elastic.Client, index string) error {
+
+	get := client.GetMapping().Index(index)
+	if !db.typeless() {
+		get = get.Type(db.Type)
+	}
+	current, err := get.Do(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get mapping of: %s", index)
+	}
+	existing, _ := db.lookupMapping(current[index])["dynamic_templates"].([]interface{})
+
+	body := mergeTemplates(mapping(), existing)
+
+	if !db.typeless() {
+		_, err := client.PutMapping().Index(index).Type(db.Type).BodyJson(body).Do(ctx)
+		return err
+	}
+
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/" + url.PathEscape(index) + "/_mapping",
+		Body:   body,
+	})
+	return err
+}
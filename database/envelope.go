@@ -0,0 +1,283 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// EnvelopeVersion is the version of the Envelope schema written by this package
+const EnvelopeVersion = 1
+
+// Status is the outcome of a plugin scan
+type Status string
+
+// Scan statuses
+const (
+	StatusOK      Status = "ok"
+	StatusError   Status = "error"
+	StatusTimeout Status = "timeout"
+	StatusSkipped Status = "skipped"
+)
+
+// Envelope is the typed, versioned results of a plugin scan, the plugin specific
+// results are in Payload which is validated against the type registered with RegisterResultType
+type Envelope struct {
+	SchemaVersion int    `json:"schema_version" malice:"required"`
+	Plugin        string `json:"plugin" malice:"required" es:"keyword"`
+	Category      string `json:"category" malice:"required" es:"keyword"`
+	PluginVersion string `json:"plugin_version,omitempty" es:"keyword"`
+	EngineVersion string `json:"engine_version,omitempty" es:"keyword"`
+	// SignatureDate is the date of the engine's signatures/definitions
+	SignatureDate *time.Time `json:"signature_date,omitempty"`
+	// Duration is how long the scan took (nanoseconds in JSON)
+	Duration time.Duration `json:"duration,omitempty"`
+	Status   Status        `json:"status" malice:"required" es:"keyword"`
+	Error    string        `json:"error,omitempty"`
+	Payload  interface{}   `json:"payload,omitempty"`
+}
+
+// AVResults is the payload of av plugins
+type AVResults struct {
+	Infected bool   `json:"infected"`
+	Result   string `json:"result"`
+	Engine   string `json:"engine" es:"keyword"`
+	Updated  string `json:"updated" es:"keyword"`
+}
+
+var (
+	resultTypesMu sync.RWMutex
+	resultTypes   = make(map[string]reflect.Type)
+)
+
+func init() {
+	RegisterResultType("av", "", AVResults{})
+}
+
+// RegisterResultType registers the payload type of a plugin, an empty name
+// registers the payload type of all plugins of the category without their own type:
+//
+//	database.RegisterResultType("exe", "pescan", pescan.Results{})
+//
+// If RegisterResultType is called twice for the same plugin or if payload is not a struct, it panics.
+func RegisterResultType(category, name string, payload interface{}) {
+	resultTypesMu.Lock()
+	defer resultTypesMu.Unlock()
+
+	t := reflect.TypeOf(payload)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		panic("database: RegisterResultType payload is not a struct")
+	}
+	key := resultTypeKey(category, name)
+	if _, dup := resultTypes[key]; dup {
+		panic("database: RegisterResultType called twice for " + key)
+	}
+	resultTypes[key] = t
+}
+
+// ResultType returns the payload type registered for the plugin falling back to its category
+func ResultType(category, name string) (reflect.Type, bool) {
+	resultTypesMu.RLock()
+	defer resultTypesMu.RUnlock()
+
+	if t, ok := resultTypes[resultTypeKey(category, name)]; ok {
+		return t, true
+	}
+	t, ok := resultTypes[resultTypeKey(category, "")]
+	return t, ok
+}
+
+// ResultTypes returns the registered payload types by "<category>/<name>" (name is empty for category types)
+func ResultTypes() map[string]reflect.Type {
+	resultTypesMu.RLock()
+	defer resultTypesMu.RUnlock()
+
+	types := make(map[string]reflect.Type, len(resultTypes))
+	for key, t := range resultTypes {
+		types[key] = t
+	}
+	return types
+}
+
+func resultTypeKey(category, name string) string {
+	return category + "/" + name
+}
+
+// Validate checks the envelope's required fields and that its payload matches the registered result type
+func (e Envelope) Validate() error {
+
+	if err := validateRequired(reflect.ValueOf(e), ""); err != nil {
+		return err
+	}
+
+	switch e.Status {
+	case StatusOK, StatusSkipped:
+	case StatusError, StatusTimeout:
+		if len(e.Error) == 0 {
+			return errors.Errorf("status %s requires an error", e.Status)
+		}
+	default:
+		return errors.Errorf("invalid status: %s", e.Status)
+	}
+
+	if e.Payload == nil {
+		return nil
+	}
+
+	t, ok := ResultType(e.Category, e.Plugin)
+	if !ok {
+		return nil
+	}
+
+	payload, err := decodePayload(e.Payload, t)
+	if err != nil {
+		return errors.Wrapf(err, "invalid payload of plugin %s", e.Plugin)
+	}
+
+	return validateRequired(payload, "payload.")
+}
+
+// PluginResults validates the envelope and converts it into the PluginResults of the sample with the given ID
+func (e Envelope) PluginResults(id string) (PluginResults, error) {
+
+	if e.SchemaVersion == 0 {
+		e.SchemaVersion = EnvelopeVersion
+	}
+
+	if err := e.Validate(); err != nil {
+		return PluginResults{}, errors.Wrapf(err, "invalid results of plugin %s", e.Plugin)
+	}
+
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return PluginResults{}, errors.Wrapf(err, "failed to encode results of plugin %s", e.Plugin)
+	}
+
+	var data map[string]interface{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return PluginResults{}, errors.Wrapf(err, "failed to encode results of plugin %s", e.Plugin)
+	}
+
+	return PluginResults{ID: id, Name: e.Plugin, Category: e.Category, Data: data}, nil
+}
+
+// Validate checks the results' merge strategy and, if Data is an Envelope (it has a
+// schema_version), the envelope and its payload
+func (r PluginResults) Validate() error {
+
+	if err := r.Merge.Validate(); err != nil {
+		return err
+	}
+	if _, ok := r.Data["schema_version"]; !ok {
+		return nil
+	}
+
+	e, err := DecodeEnvelope(r.Data)
+	if err != nil {
+		return errors.Wrapf(err, "invalid results of plugin %s", r.Name)
+	}
+	if err := e.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid results of plugin %s", r.Name)
+	}
+
+	return nil
+}
+
+// DecodeEnvelope decodes stored plugin results into an Envelope with
+// the payload decoded into a pointer to the registered result type
+func DecodeEnvelope(data map[string]interface{}) (Envelope, error) {
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	var e Envelope
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return Envelope{}, errors.Wrap(err, "failed to decode plugin results")
+	}
+	if e.SchemaVersion > EnvelopeVersion {
+		return Envelope{}, errors.Errorf("unsupported plugin results schema version %d", e.SchemaVersion)
+	}
+
+	if t, ok := ResultType(e.Category, e.Plugin); ok && e.Payload != nil {
+		payload, err := decodePayload(e.Payload, t)
+		if err != nil {
+			return Envelope{}, errors.Wrapf(err, "failed to decode payload of plugin %s", e.Plugin)
+		}
+		e.Payload = payload.Addr().Interface()
+	}
+
+	return e, nil
+}
+
+// decodePayload returns payload as a (addressable) value of type t, payloads
+// of another type (e.g. maps) are converted through JSON rejecting unknown fields
+func decodePayload(payload interface{}, t reflect.Type) (reflect.Value, error) {
+
+	v := reflect.ValueOf(payload)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Type() == t {
+		copied := reflect.New(t).Elem()
+		copied.Set(v)
+		return copied, nil
+	}
+
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	decoded := reflect.New(t)
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(decoded.Interface()); err != nil {
+		return reflect.Value{}, errors.Wrapf(err, "payload does not match %s", t)
+	}
+
+	return decoded.Elem(), nil
+}
+
+// validateRequired checks that the struct fields tagged with `malice:"required"` are not empty
+func validateRequired(v reflect.Value, prefix string) error {
+
+	var missing []string
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !tagOptions(field).required {
+			continue
+		}
+		if isEmptyValue(v.Field(i)) {
+			missing = append(missing, prefix+JSONName(field))
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.Errorf("missing required fields: %v", missing)
+	}
+
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
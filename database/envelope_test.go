@@ -0,0 +1,162 @@
+package database_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+type testPayload struct {
+	Machine  string `json:"machine" malice:"required"`
+	Sections int    `json:"sections"`
+}
+
+func init() {
+	database.RegisterResultType("exe", "envelopetest", testPayload{})
+}
+
+func TestEnvelopeValidate(t *testing.T) {
+
+	valid := database.Envelope{
+		SchemaVersion: database.EnvelopeVersion,
+		Plugin:        "envelopetest",
+		Category:      "exe",
+		Status:        database.StatusOK,
+		Payload:       testPayload{Machine: "x86"},
+	}
+
+	tests := []struct {
+		name   string
+		update func(e *database.Envelope)
+		err    string
+	}{
+		{"Valid", func(e *database.Envelope) {}, ""},
+		{"MissingFields", func(e *database.Envelope) { e.Plugin, e.Status = "", "" }, "missing required fields: [plugin status]"},
+		{"InvalidStatus", func(e *database.Envelope) { e.Status = "done" }, "invalid status: done"},
+		{"ErrorWithoutMessage", func(e *database.Envelope) { e.Status = database.StatusError }, "status error requires an error"},
+		{"TimeoutWithoutMessage", func(e *database.Envelope) { e.Status = database.StatusTimeout }, "status timeout requires an error"},
+		{"Error", func(e *database.Envelope) { e.Status, e.Error = database.StatusError, "engine crashed" }, ""},
+		{"Skipped", func(e *database.Envelope) { e.Status, e.Payload = database.StatusSkipped, nil }, ""},
+		{"MapPayload", func(e *database.Envelope) { e.Payload = map[string]interface{}{"machine": "x86", "sections": 3} }, ""},
+		{"UnknownPayloadField", func(e *database.Envelope) { e.Payload = map[string]interface{}{"machine": "x86", "entropy": 7.9} }, `unknown field "entropy"`},
+		{"MissingPayloadField", func(e *database.Envelope) { e.Payload = testPayload{Sections: 3} }, "missing required fields: [payload.machine]"},
+		{"UnregisteredPlugin", func(e *database.Envelope) { e.Plugin, e.Payload = "other", map[string]interface{}{"any": 1} }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := valid
+			tt.update(&e)
+			err := e.Validate()
+			if len(tt.err) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() returned %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Validate() returned %v, expected %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+
+	results, err := database.Envelope{
+		Plugin:   "envelopetest",
+		Category: "exe",
+		Status:   database.StatusOK,
+		Payload:  testPayload{Machine: "x86", Sections: 3},
+	}.PluginResults("id")
+	if err != nil {
+		t.Fatalf("PluginResults() failed: %v", err)
+	}
+	if results.Data["schema_version"] != float64(database.EnvelopeVersion) {
+		t.Fatalf("PluginResults() stored schema_version %v, expected %d", results.Data["schema_version"], database.EnvelopeVersion)
+	}
+
+	e, err := database.DecodeEnvelope(results.Data)
+	if err != nil {
+		t.Fatalf("DecodeEnvelope() failed: %v", err)
+	}
+	if payload, ok := e.Payload.(*testPayload); !ok || *payload != (testPayload{Machine: "x86", Sections: 3}) {
+		t.Fatalf("DecodeEnvelope() returned payload %#v, expected the registered type", e.Payload)
+	}
+
+	results.Data["schema_version"] = database.EnvelopeVersion + 1
+	if _, err := database.DecodeEnvelope(results.Data); err == nil {
+		t.Fatal("DecodeEnvelope() of a newer schema version succeeded")
+	}
+	if _, err := database.DecodeEnvelope(map[string]interface{}{"schema_version": "one"}); err == nil {
+		t.Fatal("DecodeEnvelope() of an invalid envelope succeeded")
+	}
+}
+
+func TestPluginResultsValidate(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		results database.PluginResults
+		valid   bool
+	}{
+		{"Plain", database.PluginResults{Data: map[string]interface{}{"anything": true}}, true},
+		{"UnknownMerge", database.PluginResults{Merge: "overwrite"}, false},
+		{"Envelope", database.PluginResults{Merge: database.MergeAppend, Data: map[string]interface{}{
+			"schema_version": 1, "plugin": "envelopetest", "category": "exe", "status": "ok",
+			"payload": map[string]interface{}{"machine": "x86"},
+		}}, true},
+		{"InvalidEnvelope", database.PluginResults{Data: map[string]interface{}{
+			"schema_version": 1, "plugin": "envelopetest", "category": "exe", "status": "ok",
+			"payload": map[string]interface{}{"cpu": "x86"},
+		}}, false},
+	}
+
+	for _, tt := range tests {
+		if err := tt.results.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() returned %v", tt.name, err)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+
+	schema := database.Schema("exe", "envelopetest")
+
+	if schema["$schema"] != database.JSONSchemaDraft {
+		t.Fatalf("Schema() has $schema %v", schema["$schema"])
+	}
+	if schema["title"] != "malice exe/envelopetest plugin results" {
+		t.Fatalf("Schema() has title %v", schema["title"])
+	}
+	if required := schema["required"]; !reflect.DeepEqual(required, []string{"schema_version", "plugin", "category", "status"}) {
+		t.Fatalf("Schema() requires %v", required)
+	}
+
+	properties := schema["properties"].(map[string]interface{})
+	for field, expected := range map[string]map[string]interface{}{
+		"schema_version": {"type": "integer"},
+		"signature_date": {"type": "string", "format": "date-time"},
+		"status":         {"type": "string", "enum": []database.Status{database.StatusOK, database.StatusError, database.StatusTimeout, database.StatusSkipped}},
+		"payload": {
+			"type": "object",
+			"properties": map[string]interface{}{
+				"machine":  map[string]interface{}{"type": "string"},
+				"sections": map[string]interface{}{"type": "integer"},
+			},
+			"additionalProperties": false,
+			"required":             []string{"machine"},
+		},
+	} {
+		if !reflect.DeepEqual(properties[field], expected) {
+			t.Errorf("Schema() maps %s as %v, expected %v", field, properties[field], expected)
+		}
+	}
+
+	// plugins without a registered type may store any payload
+	if payload := database.Schema("intel", "unknown")["properties"].(map[string]interface{})["payload"]; !reflect.DeepEqual(payload, map[string]interface{}{}) {
+		t.Fatalf("Schema() of a plugin without a result type maps payload as %v", payload)
+	}
+}
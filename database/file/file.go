@@ -0,0 +1,440 @@
+/*
+Package file provides a zero-dependency malice database that writes to local JSON files.
+
+The Database either appends every write as a record to a JSON-lines file or,
+when Path is a directory, keeps one merged JSON document per sample.
+*/
+package file
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Record operations written to a JSON-lines file
+const (
+	OpFileInfo      = "file_info"
+	OpHash          = "hash"
+	OpPluginResults = "plugin_results"
+)
+
+// Database is the JSON file malice database object
+type Database struct {
+	// Path is a JSON-lines file or a directory (trailing slash or existing dir) of per-sample documents
+	Path    string                 `json:"path,omitempty"`
+	Plugins map[string]interface{} `json:"plugins,omitempty"`
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// Record is a single line of a JSON-lines database file
+type Record struct {
+	ID        string                 `json:"id"`
+	Op        string                 `json:"op"`
+	Timestamp string                 `json:"timestamp"`
+	Doc       map[string]interface{} `json:"doc"`
+	// Merge is the merge strategy of plugin results records
+	Merge database.MergeStrategy `json:"merge,omitempty"`
+}
+
+// make sure file.Database satisfies the database.Database interface
+var _ database.Database = (*Database)(nil)
+
+var defaultPath string
+
+func init() {
+	defaultPath = utils.Getopt("MALICE_FILE_PATH", "malice.jsonl")
+
+	database.Register("file", open)
+}
+
+// open creates a Database from a URL like
+//
+//	file:///var/lib/malice/malice.jsonl
+//	file:///var/lib/malice/samples/
+func open(u *url.URL) (database.Database, error) {
+	path := u.Opaque
+	if len(path) == 0 {
+		path = u.Host + u.Path
+	}
+	return &Database{Path: filepath.FromSlash(path)}, nil
+}
+
+func (db *Database) getPath() {
+	if len(strings.TrimSpace(db.Path)) == 0 {
+		db.Path = defaultPath
+	}
+}
+
+// isDir returns whether the database keeps one document per sample in a directory
+func (db *Database) isDir() bool {
+	if strings.HasSuffix(db.Path, "/") || strings.HasSuffix(db.Path, string(filepath.Separator)) {
+		return true
+	}
+	info, err := os.Stat(db.Path)
+	return err == nil && info.IsDir()
+}
+
+// Init creates the database file or directory
+func (db *Database) Init(ctx context.Context) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.getPath()
+
+	if db.isDir() {
+		if err := os.MkdirAll(db.Path, 0755); err != nil {
+			return errors.Wrapf(err, "failed to create database directory: %s", db.Path)
+		}
+		log.Debugf("using database directory %s", db.Path)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(db.Path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create database directory: %s", filepath.Dir(db.Path))
+	}
+	_, err := db.openFile()
+	return err
+}
+
+// TestConnection tests that the database file or directory is writable
+func (db *Database) TestConnection(ctx context.Context) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.getPath()
+
+	if db.isDir() {
+		tmp, err := ioutil.TempFile(db.Path, ".malice")
+		if err != nil {
+			return errors.Wrapf(err, "database directory is not writable: %s", db.Path)
+		}
+		tmp.Close()
+		return os.Remove(tmp.Name())
+	}
+
+	_, err := db.openFile()
+	return err
+}
+
+// StoreFileInfo writes the initial sample info
+func (db *Database) StoreFileInfo(ctx context.Context, sample map[string]interface{}) (database.Result, error) {
+
+	doc := map[string]interface{}{
+		"file":      sample,
+		"scan_date": time.Now().Format(time.RFC3339Nano),
+	}
+	if len(db.Plugins) > 0 {
+		doc["plugins"] = db.Plugins
+	}
+
+	return db.write(ctx, database.NewID(), OpFileInfo, doc, "")
+}
+
+// StoreHash writes a hash that has been queried via intel-plugins
+func (db *Database) StoreHash(ctx context.Context, hash string) (database.Result, error) {
+
+	hashType, err := utils.GetHashType(hash)
+	if err != nil {
+		return database.Result{}, errors.Wrapf(err, "unable to detect hash type: %s", hash)
+	}
+
+	doc := map[string]interface{}{
+		"file": map[string]interface{}{
+			hashType: hash,
+		},
+		"scan_date": time.Now().Format(time.RFC3339Nano),
+	}
+	if len(db.Plugins) > 0 {
+		doc["plugins"] = db.Plugins
+	}
+
+	return db.write(ctx, database.NewID(), OpHash, doc, "")
+}
+
+// StorePluginResults writes a plugin's results under plugins.<category>.<name> of the sample with ID results.ID
+// using results.Merge
+func (db *Database) StorePluginResults(ctx context.Context, results database.PluginResults) (database.Result, error) {
+
+	if len(results.ID) == 0 {
+		return database.Result{}, errors.New("PluginResults.ID is empty (you must set this field to use this function)")
+	}
+	if err := results.Validate(); err != nil {
+		return database.Result{}, err
+	}
+
+	return db.write(ctx, results.ID, OpPluginResults, map[string]interface{}{
+		"scan_date": time.Now().Format(time.RFC3339Nano),
+		"plugins": map[string]interface{}{
+			results.Category: map[string]interface{}{
+				results.Name: results.Data,
+			},
+		},
+	}, results.Merge)
+}
+
+// Get returns the merged document of the sample with the given ID
+func (db *Database) Get(ctx context.Context, id string) (map[string]interface{}, error) {
+
+	docs, err := db.Documents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := docs[id]
+	if !ok {
+		return nil, errors.Errorf("sample with id %s not found", id)
+	}
+
+	return doc, nil
+}
+
+// Documents returns all merged sample documents by ID
+func (db *Database) Documents(ctx context.Context) (map[string]map[string]interface{}, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.getPath()
+
+	docs := make(map[string]map[string]interface{})
+
+	if db.isDir() {
+		files, err := filepath.Glob(filepath.Join(db.Path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range files {
+			doc, err := readDoc(name)
+			if err != nil {
+				return nil, err
+			}
+			docs[strings.TrimSuffix(filepath.Base(name), ".json")] = doc
+		}
+		return docs, nil
+	}
+
+	f, err := os.Open(db.Path)
+	if os.IsNotExist(err) {
+		return docs, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open database file: %s", db.Path)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s line %d", db.Path, line)
+		}
+		doc, ok := docs[rec.ID]
+		if !ok {
+			doc = make(map[string]interface{})
+			docs[rec.ID] = doc
+		}
+		apply(doc, rec.Op, rec.Doc, rec.Merge)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read database file: %s", db.Path)
+	}
+
+	return docs, nil
+}
+
+// Close closes the database file
+func (db *Database) Close() error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.file == nil {
+		return nil
+	}
+
+	err := db.file.Close()
+	db.file = nil
+
+	return err
+}
+
+func (db *Database) write(ctx context.Context, id, op string, doc map[string]interface{}, merge database.MergeStrategy) (database.Result, error) {
+
+	if err := ctx.Err(); err != nil {
+		return database.Result{}, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.getPath()
+
+	if db.isDir() {
+		if err := db.writeDoc(id, op, doc, merge); err != nil {
+			return database.Result{}, errors.Wrapf(err, "failed to write sample with id: %s", id)
+		}
+	} else {
+		if err := db.appendRecord(Record{
+			ID:        id,
+			Op:        op,
+			Timestamp: time.Now().Format(time.RFC3339Nano),
+			Doc:       doc,
+			Merge:     merge,
+		}); err != nil {
+			return database.Result{}, errors.Wrapf(err, "failed to write sample with id: %s", id)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"id":   id,
+		"op":   op,
+		"path": db.Path,
+	}).Debug("wrote sample")
+
+	return database.Result{ID: id, Index: db.Path}, nil
+}
+
+// openFile opens the JSON-lines file for appending, db.mu must be held
+func (db *Database) openFile() (*os.File, error) {
+
+	if db.file != nil {
+		return db.file, nil
+	}
+
+	f, err := os.OpenFile(db.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open database file: %s", db.Path)
+	}
+	db.file = f
+
+	return f, nil
+}
+
+// appendRecord appends a record to the JSON-lines file, db.mu must be held
+func (db *Database) appendRecord(rec Record) error {
+
+	f, err := db.openFile()
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// writeDoc applies doc to the sample's JSON document, db.mu must be held
+func (db *Database) writeDoc(id, op string, doc map[string]interface{}, merge database.MergeStrategy) error {
+
+	if id != filepath.Base(id) || strings.HasPrefix(id, ".") {
+		return errors.Errorf("invalid sample id: %s", id)
+	}
+
+	name := filepath.Join(db.Path, id+".json")
+
+	existing, err := readDoc(name)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return err
+	}
+	if existing == nil {
+		existing = make(map[string]interface{})
+	}
+	apply(existing, op, doc, merge)
+	doc = existing
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file and rename it so readers never see a partial document
+	tmp, err := ioutil.TempFile(db.Path, "."+id)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// apply applies a write to a sample document, plugin results are written with
+// their merge strategy and everything else is merged
+func apply(existing map[string]interface{}, op string, doc map[string]interface{}, merge database.MergeStrategy) {
+
+	if op != OpPluginResults {
+		database.Merge(existing, doc)
+		return
+	}
+
+	scanDate, _ := doc["scan_date"].(string)
+	plugins, _ := doc["plugins"].(map[string]interface{})
+	for category, names := range plugins {
+		names, _ := names.(map[string]interface{})
+		for name, data := range names {
+			data, _ := data.(map[string]interface{})
+			database.StoreResults(existing, database.PluginResults{
+				Category: category,
+				Name:     name,
+				Data:     data,
+				Merge:    merge,
+			}, scanDate)
+		}
+	}
+}
+
+func readDoc(name string) (map[string]interface{}, error) {
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", name)
+	}
+
+	return doc, nil
+}
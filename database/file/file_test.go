@@ -0,0 +1,64 @@
+package file
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/database/databasetest"
+)
+
+func TestConformance(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "malice-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("JSONLines", func(t *testing.T) {
+		databasetest.RunWithReadBack(t, func(t *testing.T) database.Database {
+			return &Database{Path: filepath.Join(dir, "malice.jsonl")}
+		}, readBack)
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		databasetest.RunWithReadBack(t, func(t *testing.T) database.Database {
+			return &Database{Path: filepath.Join(dir, "samples") + string(filepath.Separator)}
+		}, readBack)
+	})
+}
+
+// readBack returns the merged document of a sample
+func readBack(ctx context.Context, db database.Database, id string) (*database.Sample, error) {
+	doc, err := db.(*Database).Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	sample := database.NewSample(id, 0, "file", doc)
+	return &sample, nil
+}
+
+func TestOpenURL(t *testing.T) {
+
+	tests := map[string]string{
+		"file:///var/lib/malice/malice.jsonl": "/var/lib/malice/malice.jsonl",
+		"file:///var/lib/malice/samples/":     "/var/lib/malice/samples/",
+		"file://malice.jsonl":                 "malice.jsonl",
+		"file:malice.jsonl":                   "malice.jsonl",
+	}
+
+	for rawurl, expected := range tests {
+		db, err := database.Open(rawurl)
+		if err != nil {
+			t.Errorf("Open(%q) failed: %v", rawurl, err)
+			continue
+		}
+		if path := db.(*Database).Path; path != filepath.FromSlash(expected) {
+			t.Errorf("Open(%q) returned path %q, expected %q", rawurl, path, expected)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+/*
+Package memory provides an in-memory malice database for plugin unit tests.
+
+It records exactly what a plugin would have written and can inject failures and latency:
+
+	db := &memory.Database{}
+	db.FailWith(errors.New("cluster is down"), memory.OpStorePluginResults)
+*/
+package memory
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/pkg/errors"
+)
+
+// Operation names passed to Database.Fail, FindByHash runs as ListScans and GetPluginResults as GetSample
+const (
+	OpInit               = "Init"
+	OpTestConnection     = "TestConnection"
+	OpStoreFileInfo      = "StoreFileInfo"
+	OpStoreHash          = "StoreHash"
+	OpStorePluginResults = "StorePluginResults"
+	OpGetSample          = "GetSample"
+	OpListScans          = "ListScans"
+)
+
+// Database is the in-memory malice database object
+type Database struct {
+	Plugins map[string]interface{} `json:"plugins,omitempty"`
+
+	// Latency is added to every operation (bounded by the operation's context)
+	Latency time.Duration
+	// Fail is called before every operation, if it returns an error the operation fails with it
+	Fail func(op string) error
+
+	mu      sync.RWMutex
+	docs    map[string]*Document
+	results []database.PluginResults
+}
+
+// Document is a stored sample document
+type Document struct {
+	ID      string
+	Version int64
+	Source  map[string]interface{}
+}
+
+// make sure memory.Database satisfies the database.Database and database.Querier interfaces
+var (
+	_ database.Database = (*Database)(nil)
+	_ database.Querier  = (*Database)(nil)
+)
+
+func init() {
+	database.Register("memory", open)
+}
+
+// open creates an empty Database from a URL like
+//
+//	memory://?latency=100ms
+func open(u *url.URL) (database.Database, error) {
+
+	db := &Database{}
+
+	if latency := u.Query().Get("latency"); len(latency) > 0 {
+		d, err := time.ParseDuration(latency)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid latency: %s", latency)
+		}
+		db.Latency = d
+	}
+
+	return db, nil
+}
+
+// FailWith makes the given operations (or all operations if none are given) fail with err
+func (db *Database) FailWith(err error, ops ...string) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.Fail = func(op string) error {
+		if len(ops) == 0 || utils.StringInSlice(op, ops) {
+			return err
+		}
+		return nil
+	}
+}
+
+// Init initalizes the in-memory database
+func (db *Database) Init(ctx context.Context) error {
+	return db.begin(ctx, OpInit)
+}
+
+// TestConnection always succeeds unless a failure is injected
+func (db *Database) TestConnection(ctx context.Context) error {
+	return db.begin(ctx, OpTestConnection)
+}
+
+// StoreFileInfo stores the initial sample info
+func (db *Database) StoreFileInfo(ctx context.Context, sample map[string]interface{}) (database.Result, error) {
+
+	if err := db.begin(ctx, OpStoreFileInfo); err != nil {
+		return database.Result{}, err
+	}
+
+	doc := map[string]interface{}{
+		"file":      database.CopyValue(sample),
+		"scan_date": time.Now().Format(time.RFC3339Nano),
+	}
+	if len(db.Plugins) > 0 {
+		doc["plugins"] = database.CopyValue(db.Plugins)
+	}
+
+	return db.store(database.NewID(), doc), nil
+}
+
+// StoreHash stores a hash that has been queried via intel-plugins
+func (db *Database) StoreHash(ctx context.Context, hash string) (database.Result, error) {
+
+	if err := db.begin(ctx, OpStoreHash); err != nil {
+		return database.Result{}, err
+	}
+
+	hashType, err := utils.GetHashType(hash)
+	if err != nil {
+		return database.Result{}, errors.Wrapf(err, "unable to detect hash type: %s", hash)
+	}
+
+	doc := map[string]interface{}{
+		"file": map[string]interface{}{
+			hashType: hash,
+		},
+		"scan_date": time.Now().Format(time.RFC3339Nano),
+	}
+	if len(db.Plugins) > 0 {
+		doc["plugins"] = database.CopyValue(db.Plugins)
+	}
+
+	return db.store(database.NewID(), doc), nil
+}
+
+// StorePluginResults upserts a plugin's results under plugins.<category>.<name> of the sample with ID results.ID
+// using results.Merge
+func (db *Database) StorePluginResults(ctx context.Context, results database.PluginResults) (database.Result, error) {
+
+	if err := db.begin(ctx, OpStorePluginResults); err != nil {
+		return database.Result{}, err
+	}
+
+	if len(results.ID) == 0 {
+		return database.Result{}, errors.New("PluginResults.ID is empty (you must set this field to use this function)")
+	}
+	if err := results.Validate(); err != nil {
+		return database.Result{}, err
+	}
+
+	data, _ := database.CopyValue(results.Data).(map[string]interface{})
+	results.Data = data
+
+	db.mu.Lock()
+	db.results = append(db.results, results)
+	db.mu.Unlock()
+
+	stored := results
+	stored.Data, _ = database.CopyValue(results.Data).(map[string]interface{})
+
+	return db.apply(results.ID, func(source map[string]interface{}) {
+		database.StoreResults(source, stored, time.Now().Format(time.RFC3339Nano))
+	}), nil
+}
+
+// GetSample returns the sample with the given ID
+func (db *Database) GetSample(ctx context.Context, id string) (*database.Sample, error) {
+
+	if err := db.begin(ctx, OpGetSample); err != nil {
+		return nil, err
+	}
+
+	doc, ok := db.Get(id)
+	if !ok {
+		return nil, errors.Wrapf(database.ErrNotFound, "sample with id %s", id)
+	}
+
+	sample := database.NewSample(doc.ID, doc.Version, "memory", doc.Source)
+
+	return &sample, nil
+}
+
+// FindByHash returns all samples with the given md5, sha1, sha256 or sha512 (newest first)
+func (db *Database) FindByHash(ctx context.Context, hash string) ([]database.Sample, error) {
+	return db.ListScans(ctx, database.ScanFilter{Hash: hash})
+}
+
+// GetPluginResults returns the results of a plugin for the sample with the given ID
+func (db *Database) GetPluginResults(ctx context.Context, id, category, name string) (map[string]interface{}, error) {
+
+	sample, err := db.GetSample(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := sample.PluginResults(category, name)
+	if !ok {
+		return nil, errors.Wrapf(database.ErrNotFound, "results of plugin %s/%s for sample with id %s", category, name, id)
+	}
+
+	return data, nil
+}
+
+// ListScans returns the samples matching filter (newest first)
+func (db *Database) ListScans(ctx context.Context, filter database.ScanFilter) ([]database.Sample, error) {
+
+	if err := db.begin(ctx, OpListScans); err != nil {
+		return nil, err
+	}
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = database.DefaultScanLimit
+	}
+
+	var samples []database.Sample
+	for _, id := range db.IDs() {
+		doc, ok := db.Get(id)
+		if !ok {
+			continue
+		}
+		sample := database.NewSample(doc.ID, doc.Version, "memory", doc.Source)
+		if filter.Match(sample) {
+			samples = append(samples, sample)
+		}
+	}
+
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].ScanDate.After(samples[j].ScanDate)
+	})
+	if len(samples) > limit {
+		samples = samples[:limit]
+	}
+
+	return samples, nil
+}
+
+// Close is a no-op, the stored documents are kept
+func (db *Database) Close() error {
+	return nil
+}
+
+// Get returns a copy of the sample document with the given ID
+func (db *Database) Get(id string) (Document, bool) {
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	doc, ok := db.docs[id]
+	if !ok {
+		return Document{}, false
+	}
+
+	return Document{
+		ID:      doc.ID,
+		Version: doc.Version,
+		Source:  database.CopyValue(doc.Source).(map[string]interface{}),
+	}, true
+}
+
+// IDs returns the sorted IDs of all stored samples
+func (db *Database) IDs() []string {
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ids := make([]string, 0, len(db.docs))
+	for id := range db.docs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// List returns the plugin results in the order they were stored,
+// an empty category or name matches all categories or names
+func (db *Database) List(category, name string) []database.PluginResults {
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var list []database.PluginResults
+	for _, results := range db.results {
+		if len(category) > 0 && results.Category != category {
+			continue
+		}
+		if len(name) > 0 && results.Name != name {
+			continue
+		}
+		data, _ := database.CopyValue(results.Data).(map[string]interface{})
+		results.Data = data
+		list = append(list, results)
+	}
+
+	return list
+}
+
+// Count returns the number of stored samples
+func (db *Database) Count() int {
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return len(db.docs)
+}
+
+// Reset removes all stored samples and plugin results
+func (db *Database) Reset() {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.docs = nil
+	db.results = nil
+}
+
+// begin applies the injected latency and failures for op
+func (db *Database) begin(ctx context.Context, op string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.RLock()
+	latency, fail := db.Latency, db.Fail
+	db.mu.RUnlock()
+
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+
+	if fail != nil {
+		if err := fail(op); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// store merges source into the sample document with the given ID
+func (db *Database) store(id string, source map[string]interface{}) database.Result {
+	return db.apply(id, func(doc map[string]interface{}) {
+		database.Merge(doc, source)
+	})
+}
+
+// apply updates the document with the given ID creating it if it does not exist
+func (db *Database) apply(id string, update func(source map[string]interface{})) database.Result {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.docs == nil {
+		db.docs = make(map[string]*Document)
+	}
+
+	doc, ok := db.docs[id]
+	if !ok {
+		doc = &Document{ID: id, Source: make(map[string]interface{})}
+		db.docs[id] = doc
+	}
+	update(doc.Source)
+	doc.Version++
+
+	return database.Result{ID: id, Version: doc.Version, Index: "memory"}
+}
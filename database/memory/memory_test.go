@@ -0,0 +1,137 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/database/databasetest"
+	"github.com/pkg/errors"
+)
+
+func TestConformance(t *testing.T) {
+	databasetest.Run(t, func(t *testing.T) database.Database {
+		return &Database{Plugins: map[string]interface{}{"av": map[string]interface{}{}}}
+	})
+}
+
+func TestFailWith(t *testing.T) {
+
+	db := &Database{}
+	ctx := context.Background()
+	errDown := errors.New("cluster is down")
+
+	db.FailWith(errDown, OpStorePluginResults)
+
+	res, err := db.StoreFileInfo(ctx, databasetest.Sample(t.Name()))
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	if _, err := db.StorePluginResults(ctx, database.PluginResults{ID: res.ID, Category: "av", Name: "clamav"}); err != errDown {
+		t.Fatalf("StorePluginResults() returned %v, expected the injected error", err)
+	}
+	if n := len(db.List("", "")); n != 0 {
+		t.Fatalf("List() returned %d results of a failed write", n)
+	}
+
+	db.FailWith(errDown)
+	if err := db.TestConnection(ctx); err != errDown {
+		t.Fatalf("TestConnection() returned %v, expected the injected error", err)
+	}
+
+	db.FailWith(nil)
+	if err := db.TestConnection(ctx); err != nil {
+		t.Fatalf("TestConnection() failed after the failure was cleared: %v", err)
+	}
+
+	// reads fail like writes
+	db.FailWith(errDown, OpGetSample, OpListScans)
+	if _, err := db.GetSample(ctx, res.ID); err != errDown {
+		t.Fatalf("GetSample() returned %v, expected the injected error", err)
+	}
+	if _, err := db.GetPluginResults(ctx, res.ID, "av", "clamav"); err != errDown {
+		t.Fatalf("GetPluginResults() returned %v, expected the injected error", err)
+	}
+	if _, err := db.ListScans(ctx, database.ScanFilter{}); err != errDown {
+		t.Fatalf("ListScans() returned %v, expected the injected error", err)
+	}
+	if _, err := db.FindByHash(ctx, databasetest.Sample(t.Name())["sha256"].(string)); err != errDown {
+		t.Fatalf("FindByHash() returned %v, expected the injected error", err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+
+	db := &Database{Latency: time.Minute}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := db.StoreHash(ctx, databasetest.Sample(t.Name())["md5"].(string)); err != context.DeadlineExceeded {
+		t.Fatalf("StoreHash() returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("StoreHash() ignored the context deadline and took %s", elapsed)
+	}
+	if n := db.Count(); n != 0 {
+		t.Fatalf("Count() returned %d samples of a timed out write", n)
+	}
+
+	// reads are delayed like writes
+	if _, err := db.ListScans(ctx, database.ScanFilter{}); err != context.DeadlineExceeded {
+		t.Fatalf("ListScans() returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	db.Latency = 10 * time.Millisecond
+	start = time.Now()
+	if _, err := db.StoreHash(context.Background(), databasetest.Sample(t.Name())["md5"].(string)); err != nil {
+		t.Fatalf("StoreHash() failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < db.Latency {
+		t.Fatalf("StoreHash() took %s, expected at least %s", elapsed, db.Latency)
+	}
+}
+
+func TestListAndCount(t *testing.T) {
+
+	db := &Database{}
+	ctx := context.Background()
+
+	res, err := db.StoreFileInfo(ctx, databasetest.Sample(t.Name()))
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	for _, results := range []database.PluginResults{
+		{ID: res.ID, Category: "av", Name: "clamav", Data: map[string]interface{}{"infected": true}},
+		{ID: res.ID, Category: "av", Name: "avast", Data: map[string]interface{}{"infected": false}},
+		{ID: res.ID, Category: "exe", Name: "pe", Data: map[string]interface{}{"machine": "x86"}},
+	} {
+		if _, err := db.StorePluginResults(ctx, results); err != nil {
+			t.Fatalf("StorePluginResults() failed: %v", err)
+		}
+	}
+
+	if n := db.Count(); n != 1 {
+		t.Fatalf("Count() returned %d, expected 1", n)
+	}
+	if n := len(db.List("", "")); n != 3 {
+		t.Fatalf("List() returned %d results, expected 3", n)
+	}
+	av := db.List("av", "")
+	if len(av) != 2 || av[0].Name != "clamav" || av[1].Name != "avast" {
+		t.Fatalf("List(av) returned %+v, expected clamav and avast in write order", av)
+	}
+
+	// the listed results are copies
+	av[0].Data["infected"] = false
+	if infected := db.List("av", "clamav")[0].Data["infected"]; infected != true {
+		t.Fatalf("modifying listed results changed the stored results")
+	}
+
+	db.Reset()
+	if db.Count() != 0 || len(db.List("", "")) != 0 {
+		t.Fatal("Reset() did not remove the stored samples and results")
+	}
+}
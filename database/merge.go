@@ -0,0 +1,114 @@
+package database
+
+import "github.com/pkg/errors"
+
+// Merge merges src into dst the same way elasticsearch merges a partial document update:
+// objects are merged recursively, everything else is replaced
+func Merge(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcOK := value.(map[string]interface{})
+		dstMap, dstOK := dst[key].(map[string]interface{})
+		if srcOK && dstOK {
+			Merge(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+// MergeStrategy controls how a plugin's results are written over its previous results
+type MergeStrategy string
+
+const (
+	// MergeReplace replaces the previous results (the default)
+	MergeReplace MergeStrategy = "replace"
+	// MergeDeep merges the results into the previous results like Merge,
+	// e.g. for plugins that emit partial results incrementally
+	MergeDeep MergeStrategy = "merge"
+	// MergeAppend replaces the previous results and appends the results to
+	// the plugin's history under history.<category>.<name>
+	MergeAppend MergeStrategy = "append"
+)
+
+// Validate returns an error if s is not a known merge strategy
+func (s MergeStrategy) Validate() error {
+	switch s {
+	case "", MergeReplace, MergeDeep, MergeAppend:
+		return nil
+	}
+	return errors.Errorf("unknown merge strategy: %s", s)
+}
+
+// MergeResults returns the results stored when results are written over the
+// plugin's previous results (previous is not modified)
+func MergeResults(previous map[string]interface{}, results PluginResults) map[string]interface{} {
+	if results.Merge != MergeDeep || previous == nil {
+		return results.Data
+	}
+	merged := CopyValue(previous).(map[string]interface{})
+	Merge(merged, CopyValue(results.Data).(map[string]interface{}))
+	return merged
+}
+
+// StoreResults writes results into a sample document with the results' merge strategy
+// and records when they were written under plugin_dates.<category>.<name>
+func StoreResults(doc map[string]interface{}, results PluginResults, scanDate string) {
+
+	doc["scan_date"] = scanDate
+	childMap(childMap(doc, "plugin_dates"), results.Category)[results.Name] = scanDate
+
+	plugins := childMap(doc, "plugins")
+	category := childMap(plugins, results.Category)
+	previous, _ := category[results.Name].(map[string]interface{})
+	category[results.Name] = MergeResults(previous, results)
+
+	if results.Merge == MergeAppend {
+		history := childMap(childMap(doc, "history"), results.Category)
+		entries, _ := history[results.Name].([]interface{})
+		history[results.Name] = append(entries, HistoryDoc(results, scanDate))
+	}
+}
+
+// HistoryDoc returns the history entry a MergeAppend write appends
+func HistoryDoc(results PluginResults, scanDate string) map[string]interface{} {
+	return map[string]interface{}{
+		"scan_date": scanDate,
+		"data":      results.Data,
+	}
+}
+
+// childMap returns the object stored under key creating it if it does not exist
+func childMap(m map[string]interface{}, key string) map[string]interface{} {
+	child, ok := m[key].(map[string]interface{})
+	if !ok {
+		child = make(map[string]interface{})
+		m[key] = child
+	}
+	return child
+}
+
+// CopyValue deep copies maps and slices so stored documents never alias the caller's data
+func CopyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if v == nil {
+			return v
+		}
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[key] = CopyValue(val)
+		}
+		return m
+	case []interface{}:
+		if v == nil {
+			return v
+		}
+		s := make([]interface{}, len(v))
+		for i, val := range v {
+			s[i] = CopyValue(val)
+		}
+		return s
+	default:
+		return v
+	}
+}
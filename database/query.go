@@ -0,0 +1,238 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by Querier methods when no sample or plugin results match
+var ErrNotFound = errors.New("not found")
+
+// Querier is implemented by backends that can read back stored samples, e.g.
+// to skip a scan if the sample was already scanned with the same engine version:
+//
+//	if q, ok := db.(database.Querier); ok {
+//		scans, err := q.ListScans(ctx, database.ScanFilter{
+//			Hash: sha256, Category: "av", Name: "clamav",
+//			Fields: map[string]interface{}{"engine": engineVersion},
+//		})
+//	}
+type Querier interface {
+	// GetSample returns the sample with the given ID
+	GetSample(ctx context.Context, id string) (*Sample, error)
+	// FindByHash returns all samples with the given md5, sha1, sha256 or sha512 (newest first)
+	FindByHash(ctx context.Context, hash string) ([]Sample, error)
+	// GetPluginResults returns the results of a plugin for the sample with the given ID
+	GetPluginResults(ctx context.Context, id, category, name string) (map[string]interface{}, error)
+	// ListScans returns the samples matching filter (newest first)
+	ListScans(ctx context.Context, filter ScanFilter) ([]Sample, error)
+}
+
+// Sample is a stored malice sample document
+type Sample struct {
+	ID       string                 `json:"id"`
+	Version  int64                  `json:"version,omitempty"`
+	Index    string                 `json:"index,omitempty"`
+	File     map[string]interface{} `json:"file,omitempty"`
+	Plugins  map[string]interface{} `json:"plugins,omitempty"`
+	ScanDate time.Time              `json:"scan_date,omitempty"`
+	// Scans is the scan history of the sample (if the backend keeps one), oldest first
+	Scans []Scan `json:"scans,omitempty"`
+	// History holds the results appended by MergeAppend writes under <category>.<name>
+	History map[string]interface{} `json:"history,omitempty"`
+	// PluginDates holds when each plugin's results were last written under <category>.<name>
+	PluginDates map[string]interface{} `json:"plugin_dates,omitempty"`
+}
+
+// HistoryEntry is a plugin's results appended to its history by a MergeAppend write
+type HistoryEntry struct {
+	ScanDate time.Time              `json:"scan_date"`
+	Data     map[string]interface{} `json:"data,omitempty"`
+}
+
+// Scan is a scan of a sample
+type Scan struct {
+	ID       string    `json:"id"`
+	ScanDate time.Time `json:"scan_date"`
+	// Plugins are the plugins that stored results during the scan ("<category>/<name>")
+	Plugins []string `json:"plugins,omitempty"`
+}
+
+// NewSample creates a Sample from a stored document's source
+func NewSample(id string, version int64, index string, source map[string]interface{}) Sample {
+
+	sample := Sample{ID: id, Version: version, Index: index}
+
+	sample.File, _ = source["file"].(map[string]interface{})
+	sample.Plugins, _ = source["plugins"].(map[string]interface{})
+	sample.History, _ = source["history"].(map[string]interface{})
+	sample.PluginDates, _ = source["plugin_dates"].(map[string]interface{})
+
+	if scanDate, ok := source["scan_date"].(string); ok {
+		sample.ScanDate, _ = time.Parse(time.RFC3339Nano, scanDate)
+	}
+
+	scans, _ := source["scans"].([]interface{})
+	for _, s := range scans {
+		doc, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var scan Scan
+		scan.ID, _ = doc["id"].(string)
+		if scanDate, ok := doc["scan_date"].(string); ok {
+			scan.ScanDate, _ = time.Parse(time.RFC3339Nano, scanDate)
+		}
+		plugins, _ := doc["plugins"].([]interface{})
+		for _, p := range plugins {
+			if name, ok := p.(string); ok {
+				scan.Plugins = append(scan.Plugins, name)
+			}
+		}
+		sample.Scans = append(sample.Scans, scan)
+	}
+
+	return sample
+}
+
+// PluginResults returns the results stored under plugins.<category>.<name>
+func (s Sample) PluginResults(category, name string) (map[string]interface{}, bool) {
+	plugins, ok := s.Plugins[category].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	data, ok := plugins[name].(map[string]interface{})
+	return data, ok
+}
+
+// PluginDate returns when the results of a plugin were last written,
+// scan_date is bumped by every write to the sample so it cannot tell
+func (s Sample) PluginDate(category, name string) (time.Time, bool) {
+	plugins, _ := s.PluginDates[category].(map[string]interface{})
+	date, ok := plugins[name].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, date)
+	return t, err == nil
+}
+
+// PluginHistory returns the results appended to the history of a plugin, oldest first
+func (s Sample) PluginHistory(category, name string) []HistoryEntry {
+	plugins, _ := s.History[category].(map[string]interface{})
+	entries, _ := plugins[name].([]interface{})
+
+	var history []HistoryEntry
+	for _, e := range entries {
+		doc, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var entry HistoryEntry
+		if scanDate, ok := doc["scan_date"].(string); ok {
+			entry.ScanDate, _ = time.Parse(time.RFC3339Nano, scanDate)
+		}
+		entry.Data, _ = doc["data"].(map[string]interface{})
+		history = append(history, entry)
+	}
+
+	return history
+}
+
+// ScanFilter selects the samples returned by ListScans
+type ScanFilter struct {
+	// Hash is the md5, sha1, sha256 or sha512 of the file
+	Hash string
+	// Category only matches samples with results of plugins in this category
+	Category string
+	// Name only matches samples with results of this plugin (requires Category)
+	Name string
+	// Fields are plugin result fields that must be equal, e.g. {"engine": "0.100.1"} (requires Category and Name)
+	Fields map[string]interface{}
+	// Since only matches samples scanned at or after this time
+	Since time.Time
+	// Until only matches samples scanned at or before this time
+	Until time.Time
+	// ResultsSince only matches samples whose results of plugin Name were written at or after
+	// this time (requires Category and Name)
+	ResultsSince time.Time
+	// Limit is the maximum number of samples returned (default 100)
+	Limit int
+}
+
+// DefaultScanLimit is the number of samples ListScans returns if ScanFilter.Limit is not set
+const DefaultScanLimit = 100
+
+// Validate checks that the filter can be applied
+func (f ScanFilter) Validate() error {
+	if len(f.Hash) > 0 {
+		if _, err := utils.GetHashType(f.Hash); err != nil {
+			return errors.Wrapf(err, "unable to detect hash type: %s", f.Hash)
+		}
+	}
+	if len(f.Name) > 0 && len(f.Category) == 0 {
+		return errors.New("ScanFilter.Name requires ScanFilter.Category")
+	}
+	if len(f.Fields) > 0 && (len(f.Category) == 0 || len(f.Name) == 0) {
+		return errors.New("ScanFilter.Fields requires ScanFilter.Category and ScanFilter.Name")
+	}
+	if !f.ResultsSince.IsZero() && (len(f.Category) == 0 || len(f.Name) == 0) {
+		return errors.New("ScanFilter.ResultsSince requires ScanFilter.Category and ScanFilter.Name")
+	}
+	return nil
+}
+
+// Match returns whether the sample matches the filter, backends that cannot
+// filter natively use it to filter samples in memory
+func (f ScanFilter) Match(s Sample) bool {
+
+	if len(f.Hash) > 0 {
+		hashType, err := utils.GetHashType(f.Hash)
+		if err != nil || !strings.EqualFold(fmt.Sprint(s.File[hashType]), f.Hash) {
+			return false
+		}
+	}
+
+	if !f.Since.IsZero() && s.ScanDate.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && s.ScanDate.After(f.Until) {
+		return false
+	}
+
+	if len(f.Category) > 0 {
+		plugins, ok := s.Plugins[f.Category].(map[string]interface{})
+		if !ok || len(plugins) == 0 {
+			return false
+		}
+		if len(f.Name) > 0 {
+			data, ok := s.PluginResults(f.Category, f.Name)
+			if !ok || !fieldsMatch(data, f.Fields) {
+				return false
+			}
+			if !f.ResultsSince.IsZero() {
+				date, ok := s.PluginDate(f.Category, f.Name)
+				if !ok || date.Before(f.ResultsSince) {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// fieldsMatch returns whether data has all fields (compared by their string representation)
+func fieldsMatch(data, fields map[string]interface{}) bool {
+	for key, value := range fields {
+		if fmt.Sprint(data[key]) != fmt.Sprint(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package database_test
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/database/memory"
+)
+
+func TestOpen(t *testing.T) {
+
+	tests := []struct {
+		url     string
+		latency time.Duration
+		err     string
+	}{
+		{"memory://", 0, ""},
+		{"memory://?latency=5ms", 5 * time.Millisecond, ""},
+		{"memory://?latency=forever", 0, "failed to open memory database"},
+		{"nope://localhost/malice", 0, `unknown database scheme "nope"`},
+		{"localhost:9200", 0, `unknown database scheme "localhost"`},
+		{"%zz://", 0, "failed to parse database url"},
+	}
+
+	for _, tt := range tests {
+		db, err := database.Open(tt.url)
+		if len(tt.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Open(%q) returned %v, expected %q", tt.url, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Open(%q) failed: %v", tt.url, err)
+			continue
+		}
+		m, ok := db.(*memory.Database)
+		if !ok || m.Latency != tt.latency {
+			t.Errorf("Open(%q) returned %#v, expected a memory database with latency %s", tt.url, db, tt.latency)
+		}
+	}
+
+	// the error lists the registered schemes
+	if _, err := database.Open("nope://"); err == nil || !strings.Contains(err.Error(), "memory") {
+		t.Fatalf("Open() of an unknown scheme returned %v, expected the registered schemes", err)
+	}
+}
+
+func TestOpenFromEnv(t *testing.T) {
+
+	defer os.Setenv("MALICE_DATABASE_URL", os.Getenv("MALICE_DATABASE_URL"))
+
+	os.Unsetenv("MALICE_DATABASE_URL")
+	db, err := database.OpenFromEnv("memory://?latency=1ms")
+	if err != nil {
+		t.Fatalf("OpenFromEnv() failed: %v", err)
+	}
+	if m, ok := db.(*memory.Database); !ok || m.Latency != time.Millisecond {
+		t.Fatalf("OpenFromEnv() returned %#v, expected the default", db)
+	}
+
+	os.Setenv("MALICE_DATABASE_URL", "memory://?latency=2ms")
+	db, err = database.OpenFromEnv("memory://?latency=1ms")
+	if err != nil {
+		t.Fatalf("OpenFromEnv() failed: %v", err)
+	}
+	if m, ok := db.(*memory.Database); !ok || m.Latency != 2*time.Millisecond {
+		t.Fatalf("OpenFromEnv() returned %#v, expected MALICE_DATABASE_URL", db)
+	}
+}
+
+func TestRegister(t *testing.T) {
+
+	open := func(u *url.URL) (database.Database, error) { return &memory.Database{}, nil }
+
+	database.Register("registrytest", open)
+	found := false
+	for _, scheme := range database.Schemes() {
+		found = found || scheme == "registrytest"
+	}
+	if !found {
+		t.Fatalf("Schemes() returned %v, expected registrytest", database.Schemes())
+	}
+
+	for name, register := range map[string]func(){
+		"Duplicate": func() { database.Register("registrytest", open) },
+		"Nil":       func() { database.Register("registrynil", nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: Register() did not panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+}
@@ -0,0 +1,24 @@
+package rethinkdb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/database/databasetest"
+)
+
+// TestConformance runs against the server at MALICE_RETHINKDB_ADDRESS, e.g.
+//
+//	MALICE_RETHINKDB_ADDRESS=localhost:28015 go test ./database/rethinkdb
+func TestConformance(t *testing.T) {
+
+	address := os.Getenv("MALICE_RETHINKDB_ADDRESS")
+	if len(address) == 0 {
+		t.Skip("MALICE_RETHINKDB_ADDRESS is not set")
+	}
+
+	databasetest.Run(t, func(t *testing.T) database.Database {
+		return &Database{Address: address, DB: "malice_conformance", Table: "samples"}
+	})
+}
@@ -0,0 +1,146 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// JSONSchemaDraft is the JSON schema draft of the schemas returned by Schema and JSONSchema
+const JSONSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Schema returns the JSON schema of the Envelope of a plugin including its registered payload type
+func Schema(category, name string) map[string]interface{} {
+
+	schema := JSONSchema(Envelope{})
+	schema["title"] = "malice plugin results"
+
+	properties := schema["properties"].(map[string]interface{})
+	properties["status"].(map[string]interface{})["enum"] = []Status{StatusOK, StatusError, StatusTimeout, StatusSkipped}
+
+	if t, ok := ResultType(category, name); ok {
+		schema["title"] = "malice " + strings.TrimSuffix(category+"/"+name, "/") + " plugin results"
+		properties["payload"] = typeSchema(t)
+	}
+
+	return schema
+}
+
+// JSONSchema returns the JSON schema of v's type, struct fields are named by their json
+// tag and fields tagged with `malice:"required"` are required
+func JSONSchema(v interface{}) map[string]interface{} {
+	schema := typeSchema(reflect.TypeOf(v))
+	schema["$schema"] = JSONSchemaDraft
+	return schema
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+
+	// interfaces can hold anything
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type) map[string]interface{} {
+
+	properties := make(map[string]interface{})
+	var required []string
+
+	for _, field := range JSONFields(t) {
+		name := JSONName(field)
+		properties[name] = typeSchema(field.Type)
+		if tagOptions(field).required {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// JSONFields returns the JSON encoded fields of struct type t flattening embedded structs
+func JSONFields(t reflect.Type) []reflect.StructField {
+
+	var fields []reflect.StructField
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("json") == "-" {
+			continue
+		}
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && len(field.Tag.Get("json")) == 0 {
+			fields = append(fields, JSONFields(field.Type)...)
+			continue
+		}
+		if len(field.PkgPath) > 0 {
+			// unexported
+			continue
+		}
+		fields = append(fields, field)
+	}
+
+	return fields
+}
+
+// JSONName returns the name of a struct field in JSON
+func JSONName(field reflect.StructField) string {
+	if name := strings.Split(field.Tag.Get("json"), ",")[0]; len(name) > 0 {
+		return name
+	}
+	return field.Name
+}
+
+// fieldOptions are the options of a struct field's `malice:"..."` tag
+type fieldOptions struct {
+	required bool
+}
+
+func tagOptions(field reflect.StructField) fieldOptions {
+	var opts fieldOptions
+	for _, opt := range strings.Split(field.Tag.Get("malice"), ",") {
+		switch strings.TrimSpace(opt) {
+		case "required":
+			opts.required = true
+		}
+	}
+	return opts
+}
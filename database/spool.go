@@ -0,0 +1,561 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Spool operations
+const (
+	SpoolFileInfo      = "file_info"
+	SpoolHash          = "hash"
+	SpoolPluginResults = "plugin_results"
+)
+
+const (
+	defaultSpoolMaxEntries = 10000
+	defaultSpoolMaxBytes   = 100 << 20 // 100 MB
+	defaultSpoolInterval   = 30 * time.Second
+)
+
+// spoolFailedDir is the subdirectory of entries the backend rejected while it was reachable
+const spoolFailedDir = "failed"
+
+// spoolIDsFile holds the IDs the backend assigned to replayed samples by their sha256
+const spoolIDsFile = "ids.json"
+
+// SpoolOptions configures a Spool
+type SpoolOptions struct {
+	// Dir is the spool directory (default $MALICE_SPOOL_DIR or malice-spool in the temp dir)
+	Dir string
+	// MaxEntries is the number of queued writes after which writes fail again (default 10000)
+	MaxEntries int
+	// MaxBytes is the size of the queued writes after which writes fail again (default 100MB)
+	MaxBytes int64
+	// Interval is how often the backend is tested to replay the queued writes (default 30s)
+	Interval time.Duration
+}
+
+// SpoolEntry is a write queued in the spool directory
+type SpoolEntry struct {
+	Seq     uint64                 `json:"seq"`
+	Op      string                 `json:"op"`
+	Queued  time.Time              `json:"queued"`
+	Error   string                 `json:"error,omitempty"`
+	Sample  map[string]interface{} `json:"sample,omitempty"`
+	Hash    string                 `json:"hash,omitempty"`
+	Results *PluginResults         `json:"results,omitempty"`
+
+	size int64
+}
+
+// ID returns the ID of the sample the queued write is for
+func (e SpoolEntry) ID() string {
+	switch {
+	case e.Results != nil:
+		return e.Results.ID
+	case e.Sample != nil:
+		id, _ := SampleID(e.Sample)
+		return id
+	}
+	return e.Hash
+}
+
+// Spool wraps a backend so writes that fail because it is unreachable are queued
+// in a local directory and replayed in order once TestConnection succeeds again:
+//
+//	spool, err := database.NewSpool(ctx, db, database.SpoolOptions{Dir: "/malice/spool"})
+//	defer spool.Close()
+//	spool.StorePluginResults(ctx, results) // queued if elasticsearch is down
+//
+// While writes are queued new writes are queued behind them to keep their order.
+// A queued StoreFileInfo returns the sample's sha256 as its ID, plugin results
+// stored under that ID are written to the document the backend creates for the
+// sample once it is replayed. A queued StoreHash returns an empty Result. Entries
+// the backend rejects while it is reachable are moved to the spool's failed directory.
+type Spool struct {
+	Database
+
+	opts SpoolOptions
+
+	writeMu sync.Mutex // orders direct writes and queued writes
+
+	mu      sync.Mutex // guards the spool directory
+	seq     uint64
+	entries int
+	bytes   int64
+
+	replayMu sync.Mutex // serializes replays so writes stay in order
+
+	idMu sync.Mutex
+	ids  map[string]string // sha256 returned for queued samples -> ID assigned by the backend (persisted in ids.json)
+
+	stopC chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewSpool wraps db in a Spool replaying queued writes in the background,
+// ctx bounds the replays, call Close to stop them
+func NewSpool(ctx context.Context, db Database, opts SpoolOptions) (*Spool, error) {
+
+	if len(opts.Dir) == 0 {
+		opts.Dir = utils.Getopt("MALICE_SPOOL_DIR", filepath.Join(os.TempDir(), "malice-spool"))
+	}
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultSpoolMaxEntries
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = defaultSpoolMaxBytes
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultSpoolInterval
+	}
+
+	if err := os.MkdirAll(filepath.Join(opts.Dir, spoolFailedDir), 0755); err != nil {
+		return nil, errors.Wrapf(err, "failed to create spool directory: %s", opts.Dir)
+	}
+
+	s := &Spool{
+		Database: db,
+		opts:     opts,
+		stopC:    make(chan struct{}),
+	}
+
+	if err := s.loadIDs(); err != nil {
+		return nil, err
+	}
+
+	entries, err := s.Entries()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		s.entries++
+		s.bytes += e.size
+		s.seq = e.Seq
+	}
+	// sequence numbers are not reused so rejected writes keep their name
+	failed, err := s.Failed()
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 && failed[len(failed)-1].Seq > s.seq {
+		s.seq = failed[len(failed)-1].Seq
+	}
+	if s.entries > 0 {
+		log.WithFields(log.Fields{
+			"dir":     opts.Dir,
+			"entries": s.entries,
+		}).Info("found queued database writes")
+	}
+
+	s.wg.Add(1)
+	go s.replayer(ctx)
+
+	return s, nil
+}
+
+// StoreFileInfo writes the sample info or queues it if the backend is unreachable
+func (s *Spool) StoreFileInfo(ctx context.Context, sample map[string]interface{}) (Result, error) {
+	return s.write(ctx, SpoolEntry{Op: SpoolFileInfo, Sample: sample}, func() (Result, error) {
+		return s.Database.StoreFileInfo(ctx, sample)
+	})
+}
+
+// StoreHash writes the hash or queues it if the backend is unreachable
+func (s *Spool) StoreHash(ctx context.Context, hash string) (Result, error) {
+	return s.write(ctx, SpoolEntry{Op: SpoolHash, Hash: hash}, func() (Result, error) {
+		return s.Database.StoreHash(ctx, hash)
+	})
+}
+
+// StorePluginResults writes the plugin's results or queues them if the backend is unreachable
+func (s *Spool) StorePluginResults(ctx context.Context, results PluginResults) (Result, error) {
+
+	if len(results.ID) == 0 {
+		return Result{}, errors.New("PluginResults.ID is empty (you must set this field to use this function)")
+	}
+
+	return s.write(ctx, SpoolEntry{Op: SpoolPluginResults, Results: &results}, func() (Result, error) {
+		return s.Database.StorePluginResults(ctx, s.resolve(results))
+	})
+}
+
+// Close stops replaying queued writes and closes the backend
+func (s *Spool) Close() error {
+
+	select {
+	case <-s.stopC:
+	default:
+		close(s.stopC)
+	}
+	s.wg.Wait()
+
+	return s.Database.Close()
+}
+
+// Entries returns the queued writes in the order they are replayed
+func (s *Spool) Entries() ([]SpoolEntry, error) {
+	return readSpool(s.opts.Dir)
+}
+
+// Failed returns the queued writes the backend rejected
+func (s *Spool) Failed() ([]SpoolEntry, error) {
+	return readSpool(filepath.Join(s.opts.Dir, spoolFailedDir))
+}
+
+// Drain replays the queued writes now and returns how many were written. It stops
+// at the first write that fails because the backend is unreachable.
+func (s *Spool) Drain(ctx context.Context) (int, error) {
+
+	s.replayMu.Lock()
+	defer s.replayMu.Unlock()
+
+	entries, err := s.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, e := range entries {
+
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+
+		_, err := s.replay(ctx, e)
+		if err != nil {
+			if cerr := s.Database.TestConnection(ctx); cerr != nil {
+				return written, errors.Wrap(cerr, "database is unreachable")
+			}
+			log.WithFields(log.Fields{
+				"seq": e.Seq,
+				"op":  e.Op,
+			}).WithError(err).Error("database rejected queued write")
+			if err := s.move(e, err); err != nil {
+				return written, err
+			}
+			continue
+		}
+
+		if err := s.remove(e); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	if written > 0 {
+		log.WithFields(log.Fields{
+			"dir":     s.opts.Dir,
+			"written": written,
+		}).Info("replayed queued database writes")
+	}
+
+	return written, nil
+}
+
+// pending returns the number of queued writes
+func (s *Spool) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries
+}
+
+// write calls store directly unless writes are queued, a write that fails is
+// queued if the backend is unreachable
+func (s *Spool) write(ctx context.Context, e SpoolEntry, store func() (Result, error)) (Result, error) {
+
+	// a write must not pass another one that is being queued
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.pending() == 0 {
+		res, err := store()
+		if err == nil {
+			return res, nil
+		}
+		// errors of a reachable backend (e.g. invalid documents) would fail again when replayed
+		if cerr := s.Database.TestConnection(ctx); cerr == nil {
+			return res, err
+		}
+		e.Error = err.Error()
+	}
+
+	if err := s.enqueue(e); err != nil {
+		return Result{}, err
+	}
+
+	var res Result
+	if e.Op != SpoolHash {
+		res.ID = e.ID()
+	}
+
+	return res, nil
+}
+
+// enqueue appends an entry to the spool directory
+func (s *Spool) enqueue(e SpoolEntry) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.entries >= s.opts.MaxEntries || s.bytes >= s.opts.MaxBytes {
+		return errors.Errorf("database spool is full (%d writes, %d bytes): %s", s.entries, s.bytes, e.Error)
+	}
+
+	e.Seq = s.seq + 1
+	e.Queued = time.Now()
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s write", e.Op)
+	}
+
+	// write to a temp file and rename it so a replay never sees a partial entry
+	tmp, err := ioutil.TempFile(s.opts.Dir, ".spool")
+	if err != nil {
+		return errors.Wrapf(err, "failed to queue %s write", e.Op)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to queue %s write", e.Op)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to queue %s write", e.Op)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.opts.Dir, spoolName(e.Seq))); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to queue %s write", e.Op)
+	}
+
+	s.seq = e.Seq
+	s.entries++
+	s.bytes += int64(len(data))
+
+	log.WithFields(log.Fields{
+		"seq":     e.Seq,
+		"op":      e.Op,
+		"entries": s.entries,
+	}).Warn("database is unreachable, queued write")
+
+	return nil
+}
+
+// replay sends a queued write to the backend
+func (s *Spool) replay(ctx context.Context, e SpoolEntry) (Result, error) {
+	switch e.Op {
+	case SpoolFileInfo:
+		res, err := s.Database.StoreFileInfo(ctx, e.Sample)
+		if id, ok := SampleID(e.Sample); ok && err == nil && res.ID != id {
+			if err := s.addID(id, res.ID); err != nil {
+				// the sample is written, results stored under its sha256 are lost if the spool is reopened
+				log.WithFields(log.Fields{
+					"sha256": id,
+					"id":     res.ID,
+				}).WithError(err).Error("failed to save the ID of a replayed sample")
+			}
+		}
+		return res, err
+	case SpoolHash:
+		return s.Database.StoreHash(ctx, e.Hash)
+	case SpoolPluginResults:
+		if e.Results != nil {
+			return s.Database.StorePluginResults(ctx, s.resolve(*e.Results))
+		}
+	}
+	return Result{}, errors.Errorf("invalid spool entry %d: %s", e.Seq, e.Op)
+}
+
+// resolve replaces the sha256 returned for a queued sample by the ID the backend assigned to it when replayed
+func (s *Spool) resolve(results PluginResults) PluginResults {
+
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	if id, ok := s.ids[results.ID]; ok {
+		results.ID = id
+	}
+
+	return results
+}
+
+// addID records the ID the backend assigned to a replayed sample
+func (s *Spool) addID(sha256, id string) error {
+
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	if s.ids == nil {
+		s.ids = make(map[string]string)
+	}
+	s.ids[sha256] = id
+
+	data, err := json.Marshal(s.ids)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode sample IDs")
+	}
+
+	// plugins may store results under the sha256 long after the sample was replayed
+	tmp, err := ioutil.TempFile(s.opts.Dir, ".ids")
+	if err != nil {
+		return errors.Wrap(err, "failed to save sample IDs")
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to save sample IDs")
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to save sample IDs")
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(s.opts.Dir, spoolIDsFile)); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "failed to save sample IDs")
+	}
+
+	return nil
+}
+
+// loadIDs reads the IDs of samples replayed before the spool was reopened
+func (s *Spool) loadIDs() error {
+
+	data, err := ioutil.ReadFile(filepath.Join(s.opts.Dir, spoolIDsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to read sample IDs")
+	}
+
+	s.idMu.Lock()
+	defer s.idMu.Unlock()
+
+	if err := json.Unmarshal(data, &s.ids); err != nil {
+		return errors.Wrapf(err, "failed to parse sample IDs: %s", spoolIDsFile)
+	}
+
+	return nil
+}
+
+// remove deletes a replayed entry
+func (s *Spool) remove(e SpoolEntry) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(s.opts.Dir, spoolName(e.Seq))); err != nil {
+		return errors.Wrapf(err, "failed to remove replayed write %d", e.Seq)
+	}
+	s.entries--
+	s.bytes -= e.size
+
+	return nil
+}
+
+// move moves a rejected entry to the failed directory
+func (s *Spool) move(e SpoolEntry, err error) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.Error = err.Error()
+	data, merr := json.Marshal(e)
+	if merr != nil {
+		return errors.Wrapf(merr, "failed to encode %s write", e.Op)
+	}
+
+	name := spoolName(e.Seq)
+	if err := ioutil.WriteFile(filepath.Join(s.opts.Dir, spoolFailedDir, name), data, 0644); err != nil {
+		return errors.Wrapf(err, "failed to move rejected write %d", e.Seq)
+	}
+	if err := os.Remove(filepath.Join(s.opts.Dir, name)); err != nil {
+		return errors.Wrapf(err, "failed to remove rejected write %d", e.Seq)
+	}
+	s.entries--
+	s.bytes -= e.size
+
+	return nil
+}
+
+// replayer replays the queued writes once the backend is reachable again
+func (s *Spool) replayer(ctx context.Context) {
+
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopC:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if s.pending() == 0 {
+				continue
+			}
+			if err := s.Database.TestConnection(ctx); err != nil {
+				log.WithError(err).Debug("database is still unreachable")
+				continue
+			}
+			if _, err := s.Drain(ctx); err != nil {
+				log.WithError(err).Warn("failed to replay queued database writes")
+			}
+		}
+	}
+}
+
+// spoolName returns the file name of an entry, sorting names sorts entries
+func spoolName(seq uint64) string {
+	return fmt.Sprintf("%020d.json", seq)
+}
+
+// readSpool reads the entries of a spool directory ordered by sequence number
+func readSpool(dir string) ([]SpoolEntry, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read spool directory: %s", dir)
+	}
+
+	var entries []SpoolEntry
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64); err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read spool entry: %s", name)
+		}
+		var e SpoolEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse spool entry: %s", name)
+		}
+		e.size = f.Size()
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+
+	return entries, nil
+}
@@ -0,0 +1,165 @@
+package database_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/database/databasetest"
+	"github.com/malice-plugins/go-plugin-utils/database/memory"
+	"github.com/pkg/errors"
+)
+
+func testSpool(t *testing.T, db database.Database, opts database.SpoolOptions) (*database.Spool, func()) {
+
+	dir, err := ioutil.TempDir("", "malice-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Dir = dir
+	// replays are started by the tests
+	opts.Interval = time.Hour
+
+	spool, err := database.NewSpool(context.Background(), db, opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("NewSpool() failed: %v", err)
+	}
+
+	return spool, func() {
+		spool.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSpoolOutage(t *testing.T) {
+
+	ctx := context.Background()
+	db := &memory.Database{}
+	spool, stop := testSpool(t, db, database.SpoolOptions{})
+	defer stop()
+
+	db.FailWith(errors.New("cluster is down"))
+
+	sample := databasetest.Sample(t.Name())
+	res, err := spool.StoreFileInfo(ctx, sample)
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	if res.ID != sample["sha256"] {
+		t.Fatalf("StoreFileInfo() returned ID %s, expected the sample's sha256", res.ID)
+	}
+	for _, results := range []database.PluginResults{
+		{ID: res.ID, Category: "av", Name: "clamav", Data: map[string]interface{}{"result": "clean"}},
+		{ID: res.ID, Category: "av", Name: "avast", Merge: "bogus", Data: map[string]interface{}{"result": "clean"}},
+	} {
+		if _, err := spool.StorePluginResults(ctx, results); err != nil {
+			t.Fatalf("StorePluginResults() failed: %v", err)
+		}
+	}
+
+	// writes are queued behind the queued ones once the database is back
+	db.FailWith(nil)
+	if _, err := spool.StorePluginResults(ctx, database.PluginResults{ID: res.ID, Category: "av", Name: "clamav", Data: map[string]interface{}{"result": "EICAR"}}); err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	if db.Count() != 0 {
+		t.Fatalf("StorePluginResults() passed the queued writes")
+	}
+	if entries, err := spool.Entries(); err != nil || len(entries) != 4 {
+		t.Fatalf("Entries() returned %d entries, %v, expected 4", len(entries), err)
+	}
+
+	written, err := spool.Drain(ctx)
+	if err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+	if written != 3 {
+		t.Fatalf("Drain() wrote %d entries, expected 3", written)
+	}
+	if entries, err := spool.Entries(); err != nil || len(entries) != 0 {
+		t.Fatalf("Entries() returned %d entries, %v after Drain()", len(entries), err)
+	}
+	failed, err := spool.Failed()
+	if err != nil || len(failed) != 1 || failed[0].Results == nil || failed[0].Results.Name != "avast" {
+		t.Fatalf("Failed() returned %+v, %v, expected the rejected avast results", failed, err)
+	}
+
+	ids := db.IDs()
+	if len(ids) != 1 {
+		t.Fatalf("Drain() stored %d samples, expected 1", len(ids))
+	}
+	clamav := db.List("av", "clamav")
+	if len(clamav) != 2 || clamav[0].Data["result"] != "clean" || clamav[1].Data["result"] != "EICAR" {
+		t.Fatalf("Drain() stored clamav results %+v, expected them in the order they were written", clamav)
+	}
+	for _, results := range clamav {
+		if results.ID != ids[0] {
+			t.Fatalf("Drain() stored clamav results under %s, expected the ID of the sample %s", results.ID, ids[0])
+		}
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+
+	ctx := context.Background()
+	db := &memory.Database{}
+	spool, stop := testSpool(t, db, database.SpoolOptions{MaxEntries: 1})
+	defer stop()
+
+	db.FailWith(errors.New("cluster is down"))
+
+	if _, err := spool.StoreHash(ctx, "d41d8cd98f00b204e9800998ecf8427e"); err != nil {
+		t.Fatalf("StoreHash() failed: %v", err)
+	}
+	if _, err := spool.StoreHash(ctx, "d41d8cd98f00b204e9800998ecf8427e"); err == nil {
+		t.Fatal("StoreHash() of a full spool succeeded")
+	}
+}
+
+func TestSpoolResolvesID(t *testing.T) {
+
+	ctx := context.Background()
+	db := &memory.Database{}
+
+	dir, err := ioutil.TempDir("", "malice-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := database.SpoolOptions{Dir: dir, Interval: time.Hour}
+
+	spool, err := database.NewSpool(ctx, db, opts)
+	if err != nil {
+		t.Fatalf("NewSpool() failed: %v", err)
+	}
+
+	db.FailWith(errors.New("cluster is down"))
+	res, err := spool.StoreFileInfo(ctx, databasetest.Sample(t.Name()))
+	if err != nil {
+		t.Fatalf("StoreFileInfo() failed: %v", err)
+	}
+	db.FailWith(nil)
+	if _, err := spool.Drain(ctx); err != nil {
+		t.Fatalf("Drain() failed: %v", err)
+	}
+	spool.Close()
+
+	// plugins may store results under the returned sha256 after the spool was reopened
+	spool, err = database.NewSpool(ctx, db, opts)
+	if err != nil {
+		t.Fatalf("NewSpool() failed: %v", err)
+	}
+	defer spool.Close()
+
+	stored, err := spool.StorePluginResults(ctx, database.PluginResults{ID: res.ID, Category: "av", Name: "clamav", Data: map[string]interface{}{"result": "clean"}})
+	if err != nil {
+		t.Fatalf("StorePluginResults() failed: %v", err)
+	}
+	if ids := db.IDs(); len(ids) != 1 || stored.ID != ids[0] {
+		t.Fatalf("StorePluginResults() stored the results under %s, expected the ID of the sample %v", stored.ID, ids)
+	}
+}
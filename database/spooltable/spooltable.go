@@ -0,0 +1,40 @@
+/*
+Package spooltable prints the writes queued in a database.Spool, it is kept out of
+package database so plugins do not depend on the table library:
+
+	entries, err := spool.Entries()
+	if err != nil {
+		log.Fatal(err)
+	}
+	spooltable.New(entries).Print()
+*/
+package spooltable
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/clitable"
+	"github.com/malice-plugins/go-plugin-utils/database"
+)
+
+// New returns the queued writes as a table
+func New(entries []database.SpoolEntry) *clitable.Table {
+
+	table := clitable.New([]string{"Seq", "Op", "ID", "Queued", "Error"})
+	for _, e := range entries {
+		id := e.ID()
+		if e.Results != nil {
+			id = fmt.Sprintf("%s (%s/%s)", e.Results.ID, e.Results.Category, e.Results.Name)
+		}
+		table.AddRow(map[string]interface{}{
+			"Seq":    e.Seq,
+			"Op":     e.Op,
+			"ID":     id,
+			"Queued": e.Queued.Format(time.RFC3339),
+			"Error":  e.Error,
+		})
+	}
+
+	return table
+}
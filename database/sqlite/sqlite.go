@@ -0,0 +1,392 @@
+/*
+Package sqlite provides an embedded SQLite malice database for single plugin deployments.
+
+Samples, scans and plugin results are stored in normalized tables,
+plugin results keep their data as a JSON column.
+*/
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/utils"
+	log "github.com/sirupsen/logrus"
+	// register the sqlite3 database/sql driver
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// Database is the sqlite malice database object
+type Database struct {
+	// Path is the SQLite database file (or :memory:)
+	Path    string                 `json:"path,omitempty"`
+	Plugins map[string]interface{} `json:"plugins,omitempty"`
+
+	mu sync.Mutex
+	db *sql.DB
+}
+
+// make sure sqlite.Database satisfies the database.Database interface
+var _ database.Database = (*Database)(nil)
+
+// migrations are applied in order by Init, never change a released migration, append a new one
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE samples (
+		id         TEXT PRIMARY KEY,
+		md5        TEXT,
+		sha1       TEXT,
+		sha256     TEXT,
+		sha512     TEXT,
+		name       TEXT,
+		mime       TEXT,
+		size       TEXT,
+		file       TEXT NOT NULL DEFAULT '{}',
+		plugins    TEXT,
+		created_at TEXT NOT NULL
+	);
+	CREATE INDEX samples_md5 ON samples (md5);
+	CREATE INDEX samples_sha1 ON samples (sha1);
+	CREATE INDEX samples_sha256 ON samples (sha256);
+	CREATE INDEX samples_sha512 ON samples (sha512);
+
+	CREATE TABLE scans (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		sample_id TEXT NOT NULL REFERENCES samples (id),
+		scan_date TEXT NOT NULL
+	);
+	CREATE INDEX scans_sample_id ON scans (sample_id);
+
+	CREATE TABLE plugin_results (
+		sample_id  TEXT NOT NULL REFERENCES samples (id),
+		category   TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		data       TEXT,
+		version    INTEGER NOT NULL DEFAULT 1,
+		updated_at TEXT NOT NULL,
+		PRIMARY KEY (sample_id, category, name)
+	);
+	CREATE INDEX plugin_results_plugin ON plugin_results (category, name);`,
+	// 2: results appended by database.MergeAppend writes
+	`CREATE TABLE plugin_history (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		sample_id  TEXT NOT NULL REFERENCES samples (id),
+		category   TEXT NOT NULL,
+		name       TEXT NOT NULL,
+		data       TEXT,
+		created_at TEXT NOT NULL
+	);
+	CREATE INDEX plugin_history_sample ON plugin_history (sample_id, category, name);`,
+}
+
+var defaultPath string
+
+func init() {
+	defaultPath = utils.Getopt("MALICE_SQLITE_PATH", "malice.db")
+
+	database.Register("sqlite", open)
+}
+
+// open creates a Database from a URL like
+//
+//	sqlite:///var/lib/malice/malice.db
+//	sqlite::memory:
+func open(u *url.URL) (database.Database, error) {
+	path := u.Opaque
+	if len(path) == 0 {
+		path = filepath.FromSlash(u.Host + u.Path)
+	}
+	return &Database{Path: path}, nil
+}
+
+// getDB returns the database's connection pool opening it on first use
+func (db *Database) getDB() (*sql.DB, error) {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.db != nil {
+		return db.db, nil
+	}
+
+	if len(strings.TrimSpace(db.Path)) == 0 {
+		db.Path = defaultPath
+	}
+
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000&_foreign_keys=1", db.Path))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open sqlite database: %s", db.Path)
+	}
+	// sqlite only allows a single writer, serialize access instead of failing with "database is locked"
+	conn.SetMaxOpenConns(1)
+
+	db.db = conn
+
+	return conn, nil
+}
+
+// Init initalizes SQLite for use with malice by applying the schema migrations
+func (db *Database) Init(ctx context.Context) error {
+
+	conn, err := db.getDB()
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return errors.Wrap(err, "failed to create schema_migrations table")
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return errors.Wrap(err, "failed to read schema version")
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		err := db.tx(ctx, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, now())
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply schema migration %d", version)
+		}
+		log.Debugf("applied schema migration %d", version)
+	}
+
+	return nil
+}
+
+// TestConnection tests the SQLite connection
+func (db *Database) TestConnection(ctx context.Context) error {
+
+	conn, err := db.getDB()
+	if err != nil {
+		return err
+	}
+
+	if err := conn.PingContext(ctx); err != nil {
+		return errors.Wrapf(err, "failed to connect to sqlite database: %s", db.Path)
+	}
+
+	return nil
+}
+
+// StoreFileInfo inserts initial sample info into database
+func (db *Database) StoreFileInfo(ctx context.Context, sample map[string]interface{}) (database.Result, error) {
+
+	id := database.NewID()
+
+	err := db.insertSample(ctx, id, sample)
+	if err != nil {
+		return database.Result{}, errors.Wrap(err, "failed to insert file info")
+	}
+
+	return database.Result{ID: id, Version: 1, Index: "samples"}, nil
+}
+
+// StoreHash stores a hash into the database that has been queried via intel-plugins
+func (db *Database) StoreHash(ctx context.Context, hash string) (database.Result, error) {
+
+	hashType, err := utils.GetHashType(hash)
+	if err != nil {
+		return database.Result{}, errors.Wrapf(err, "unable to detect hash type: %s", hash)
+	}
+
+	id := database.NewID()
+
+	err = db.insertSample(ctx, id, map[string]interface{}{hashType: hash})
+	if err != nil {
+		return database.Result{}, errors.Wrapf(err, "unable to insert hash: %s", hash)
+	}
+
+	return database.Result{ID: id, Version: 1, Index: "samples"}, nil
+}
+
+// StorePluginResults upserts a plugin's results for the sample with ID results.ID using results.Merge
+func (db *Database) StorePluginResults(ctx context.Context, results database.PluginResults) (database.Result, error) {
+
+	if len(results.ID) == 0 {
+		return database.Result{}, errors.New("PluginResults.ID is empty (you must set this field to use this function)")
+	}
+	if err := results.Validate(); err != nil {
+		return database.Result{}, err
+	}
+
+	var version int64
+
+	err := db.tx(ctx, func(tx *sql.Tx) error {
+		// plugin results may arrive before (or without) the file info
+		if _, err := tx.ExecContext(ctx,
+			`INSERT OR IGNORE INTO samples (id, created_at) VALUES (?, ?)`,
+			results.ID, now(),
+		); err != nil {
+			return err
+		}
+		stored := results.Data
+		if results.Merge == database.MergeDeep {
+			previous, err := previousResults(ctx, tx, results)
+			if err != nil {
+				return err
+			}
+			stored = database.MergeResults(previous, results)
+		}
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode results of plugin %s", results.Name)
+		}
+		if results.Merge == database.MergeAppend {
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO plugin_history (sample_id, category, name, data, created_at) VALUES (?, ?, ?, ?, ?)`,
+				results.ID, results.Category, results.Name, string(data), now(),
+			); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO plugin_results (sample_id, category, name, data, updated_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (sample_id, category, name) DO UPDATE SET
+				data = excluded.data,
+				version = version + 1,
+				updated_at = excluded.updated_at`,
+			results.ID, results.Category, results.Name, string(data), now(),
+		); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx,
+			`SELECT version FROM plugin_results WHERE sample_id = ? AND category = ? AND name = ?`,
+			results.ID, results.Category, results.Name,
+		).Scan(&version)
+	})
+	if err != nil {
+		return database.Result{}, errors.Wrapf(err, "failed to upsert results for sample with id: %s", results.ID)
+	}
+
+	log.WithFields(log.Fields{
+		"id":       results.ID,
+		"category": results.Category,
+		"plugin":   results.Name,
+		"version":  version,
+	}).Debug("upserted plugin results")
+
+	return database.Result{ID: results.ID, Version: version, Index: "plugin_results"}, nil
+}
+
+// previousResults returns the stored results of the plugin (nil if there are none)
+func previousResults(ctx context.Context, tx *sql.Tx, results database.PluginResults) (map[string]interface{}, error) {
+
+	var data sql.NullString
+	err := tx.QueryRowContext(ctx,
+		`SELECT data FROM plugin_results WHERE sample_id = ? AND category = ? AND name = ?`,
+		results.ID, results.Category, results.Name,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !data.Valid {
+		return nil, nil
+	}
+
+	var previous map[string]interface{}
+	if err := json.Unmarshal([]byte(data.String), &previous); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode results of plugin %s", results.Name)
+	}
+
+	return previous, nil
+}
+
+// Close closes the SQLite database
+func (db *Database) Close() error {
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.db == nil {
+		return nil
+	}
+
+	err := db.db.Close()
+	db.db = nil
+
+	return err
+}
+
+func (db *Database) insertSample(ctx context.Context, id string, sample map[string]interface{}) error {
+
+	file, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+
+	var plugins interface{}
+	if len(db.Plugins) > 0 {
+		p, err := json.Marshal(db.Plugins)
+		if err != nil {
+			return err
+		}
+		plugins = string(p)
+	}
+
+	field := func(key string) interface{} {
+		if value, ok := sample[key]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return nil
+	}
+
+	return db.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO samples (id, md5, sha1, sha256, sha512, name, mime, size, file, plugins, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, field("md5"), field("sha1"), field("sha256"), field("sha512"),
+			field("name"), field("mime"), field("size"), string(file), plugins, now(),
+		); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `INSERT INTO scans (sample_id, scan_date) VALUES (?, ?)`, id, now())
+		return err
+	})
+}
+
+// tx runs fn in a transaction committing it if fn succeeds
+func (db *Database) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+
+	conn, err := db.getDB()
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func now() string {
+	return time.Now().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,115 @@
+package sqlite
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/malice-plugins/go-plugin-utils/database"
+	"github.com/malice-plugins/go-plugin-utils/database/databasetest"
+)
+
+func TestConformance(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "malice-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	databasetest.RunWithReadBack(t, func(t *testing.T) database.Database {
+		return &Database{Path: filepath.Join(dir, "malice.db")}
+	}, readBack)
+}
+
+// readBack reads the results of a sample from plugin_results and their
+// MergeAppend history from plugin_history
+func readBack(ctx context.Context, db database.Database, id string) (*database.Sample, error) {
+
+	sqlDB, err := db.(*Database).getDB()
+	if err != nil {
+		return nil, err
+	}
+
+	source := map[string]interface{}{}
+	for _, table := range []struct {
+		name  string
+		query string
+	}{
+		{"plugins", `SELECT category, name, data, updated_at FROM plugin_results WHERE sample_id = ?`},
+		{"history", `SELECT category, name, data, created_at FROM plugin_history WHERE sample_id = ? ORDER BY id`},
+	} {
+		rows, err := sqlDB.QueryContext(ctx, table.query, id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var category, name, data, date string
+			if err := rows.Scan(&category, &name, &data, &date); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			var results map[string]interface{}
+			if err := json.Unmarshal([]byte(data), &results); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			tables, _ := source[table.name].(map[string]interface{})
+			if tables == nil {
+				tables = map[string]interface{}{}
+				source[table.name] = tables
+			}
+			plugins, _ := tables[category].(map[string]interface{})
+			if plugins == nil {
+				plugins = map[string]interface{}{}
+				tables[category] = plugins
+			}
+			if table.name == "plugins" {
+				plugins[name] = results
+				continue
+			}
+			entries, _ := plugins[name].([]interface{})
+			plugins[name] = append(entries, database.HistoryDoc(database.PluginResults{Data: results}, date))
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	sample := database.NewSample(id, 0, "samples", source)
+	return &sample, nil
+}
+
+func TestOpenURL(t *testing.T) {
+
+	tests := map[string]string{
+		"sqlite:///var/lib/malice/malice.db": filepath.FromSlash("/var/lib/malice/malice.db"),
+		"sqlite://malice.db":                 "malice.db",
+		"sqlite:malice.db":                   "malice.db",
+		"sqlite::memory:":                    ":memory:",
+	}
+
+	for rawurl, expected := range tests {
+		db, err := database.Open(rawurl)
+		if err != nil {
+			t.Errorf("Open(%q) failed: %v", rawurl, err)
+			continue
+		}
+		if path := db.(*Database).Path; path != expected {
+			t.Errorf("Open(%q) returned path %q, expected %q", rawurl, path, expected)
+		}
+	}
+
+	// an in-memory database works end to end
+	db, _ := database.Open("sqlite::memory:")
+	defer db.Close()
+	if err := db.Init(context.Background()); err != nil {
+		t.Fatalf("Init() of sqlite::memory: failed: %v", err)
+	}
+	if _, err := db.StoreFileInfo(context.Background(), databasetest.Sample(t.Name())); err != nil {
+		t.Fatalf("StoreFileInfo() of sqlite::memory: failed: %v", err)
+	}
+}
@@ -1,3 +1,21 @@
 module github.com/malice-plugins/go-plugin-utils
 
-require github.com/olivere/elastic v0.0.0-20180828092110-66b430cdba34 // indirect
+go 1.13
+
+require (
+	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
+	github.com/golang/protobuf v1.3.4 // indirect
+	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
+	github.com/mattn/go-runewidth v0.0.9
+	github.com/mattn/go-sqlite3 v1.14.6
+	github.com/moul/http2curl v1.0.0 // indirect
+	github.com/olivere/elastic v0.0.0-20180828092110-66b430cdba34
+	github.com/parnurzeal/gorequest v0.3.0
+	github.com/pkg/errors v0.8.0
+	github.com/sirupsen/logrus v1.0.6
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073 // indirect
+	golang.org/x/net v0.0.0-20190404232315-eb5bcb51f2a3 // indirect
+	golang.org/x/sys v0.0.0-20191120155948-bd437916bb0e // indirect
+	gopkg.in/fatih/pool.v2 v2.0.0 // indirect
+	gopkg.in/gorethink/gorethink.v3 v3.0.5
+)
@@ -14,7 +14,7 @@ import (
 	"strconv"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
+	log "github.com/sirupsen/logrus"
 )
 
 const regexAddressConn string = `^([a-z]{3,}):\/\/([^:]+):?([0-9]+)?$`
@@ -71,7 +71,7 @@ func buildConn(host string, port int, fullConn string) *Connection {
 func pingTCP(conn *Connection, timeoutSeconds int) error {
 	timeout := time.Duration(timeoutSeconds) * time.Second
 	start := time.Now()
-	address := fmt.Sprintf("%s:%d", conn.Host, conn.Port)
+	address := net.JoinHostPort(conn.Host, strconv.Itoa(conn.Port))
 	log.Debug("Dial address: " + address)
 
 	for {